@@ -5,6 +5,14 @@ package main
 Given an ID (1159324849) this will recursively delete everything
 in PREFIX/115/932/484/9 - that is all (20181226/thisisaaronland)
 
+Or, with a scope, only some of it: the primary record, some or all
+of its alternate geometries or everything including derived files
+like images. Scopes can be set for all IDs with the -scope flag or
+for a single ID like this: 1159324849:primary,alt=quattroshapes
+
+On versioned buckets deleting something only hides it; see versions.go
+for permanently purging things or bringing them back.
+
 */
 
 import (
@@ -12,80 +20,415 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	go_lambda "github.com/aws/aws-lambda-go/lambda"
 	aws_lambda "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/whosonfirst/go-whosonfirst-aws/lambda"
-	"github.com/whosonfirst/go-whosonfirst-aws/s3"
+	"github.com/whosonfirst/go-whosonfirst-s3"
 	"github.com/whosonfirst/go-whosonfirst-uri"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 type DeleteOptions struct {
-	DSN    string `json:"dsn"`
-	Dryrun bool   `json:"dryrun"`
-	ID     int64  `json:"id"`
+	DSN        string `json:"dsn"`
+	Dryrun     bool   `json:"dryrun"`
+	ID         int64  `json:"id"`
+	Scope      string `json:"scope"`      // see parseScope; if empty everything is deleted
+	Quarantine string `json:"quarantine"` // if set objects are moved to this prefix, rather than deleted; see quarantine.go
+	Purge      bool   `json:"purge"`      // if true every version of every object is deleted; see versions.go
+	Undelete   bool   `json:"undelete"`   // if true the latest delete marker for every object is deleted; see versions.go
+}
+
+// versioned reports whether opts operate on object versions rather than objects.
+
+func (opts DeleteOptions) versioned() bool {
+	return opts.Purge || opts.Undelete
+}
+
+// validate checks that opts don't ask for more than one way of deleting things.
+
+func validate(opts DeleteOptions) error {
+
+	if opts.Purge && opts.Undelete {
+		return errors.New("Objects can not be purged and undeleted at the same time")
+	}
+
+	if opts.versioned() && opts.Quarantine != "" {
+		return errors.New("Objects can not be purged or undeleted and quarantined at the same time")
+	}
+
+	return nil
+}
+
+// deleteScope is what to delete for an ID.
+
+type deleteScope struct {
+	all      bool           // everything in the ID's directory, including derived files
+	primary  bool           // {ID}.geojson
+	alts     bool           // every alternate geometry
+	alt_args []*uri.URIArgs // specific alternate geometries
 }
 
-func append_id(ids []int64, str_id string) ([]int64, error) {
+// parseScope parses a comma-separated list of: "all", "primary", "alt" (every
+// alternate geometry) or "alt={LABEL}" where LABEL is an alternate geometry's
+// source, function and extras joined by dashes, as they appear in its
+// filename. For example "primary,alt=quattroshapes".
+
+func parseScope(str_scope string) (*deleteScope, error) {
+
+	sc := deleteScope{
+		alt_args: make([]*uri.URIArgs, 0),
+	}
+
+	if str_scope == "" {
+		str_scope = "all"
+	}
+
+	for _, part := range strings.Split(str_scope, ",") {
+
+		part = strings.TrimSpace(part)
+
+		switch {
+		case part == "all":
+			sc.all = true
+		case part == "primary":
+			sc.primary = true
+		case part == "alt":
+			sc.alts = true
+		case strings.HasPrefix(part, "alt="):
+
+			label := strings.TrimPrefix(part, "alt=")
+			parts := strings.Split(label, "-")
+
+			if parts[0] == "" {
+				return nil, fmt.Errorf("Invalid alternate geometry '%s'", label)
+			}
+
+			function := ""
+
+			if len(parts) > 1 {
+				function = parts[1]
+			}
+
+			extras := make([]string, 0)
+
+			if len(parts) > 2 {
+				extras = parts[2:]
+			}
+
+			sc.alt_args = append(sc.alt_args, uri.NewAlternateURIArgs(parts[0], function, extras...))
+
+		default:
+			return nil, fmt.Errorf("Invalid scope '%s'", part)
+		}
+	}
+
+	return &sc, nil
+}
+
+// matches reports whether key, which is in the directory for id, is in scope.
+
+func (sc *deleteScope) matches(id int64, key string) (bool, error) {
+
+	if sc.all {
+		return true, nil
+	}
+
+	fname := filepath.Base(key)
+
+	if sc.primary {
+
+		primary, err := uri.Id2Fname(id)
+
+		if err != nil {
+			return false, err
+		}
+
+		if fname == primary {
+			return true, nil
+		}
+	}
+
+	if sc.alts {
+
+		alt, err := uri.AltGeomFromPath(fname)
+
+		if err != nil {
+			return false, err
+		}
+
+		if alt != nil {
+
+			alt_id, err := uri.IdFromPath(fname)
+
+			if err != nil {
+				return false, err
+			}
+
+			if alt_id == id {
+				return true, nil
+			}
+		}
+	}
+
+	for _, args := range sc.alt_args {
+
+		alt, err := uri.Id2Fname(id, args)
+
+		if err != nil {
+			return false, err
+		}
+
+		if fname == alt {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// append_target parses str_target, which is an ID optionally followed by a
+// colon and a scope, and appends a copy of opts for it to targets.
+
+func append_target(targets []DeleteOptions, opts DeleteOptions, str_target string) ([]DeleteOptions, error) {
+
+	str_target = strings.TrimSpace(str_target)
+
+	str_id := str_target
+	str_scope := ""
+
+	idx := strings.Index(str_target, ":")
+
+	if idx != -1 {
+		str_id = str_target[0:idx]
+		str_scope = str_target[idx+1:]
+	}
 
 	id, err := strconv.ParseInt(str_id, 10, 64)
 
 	if err != nil {
-		return ids, err
+		return targets, err
+	}
+
+	opts.ID = id
+
+	if str_scope != "" {
+		opts.Scope = str_scope
+	}
+
+	// make sure typos are caught before anything is deleted
+
+	_, err = parseScope(opts.Scope)
+
+	if err != nil {
+		return targets, err
 	}
 
-	ids = append(ids, id)
-	return ids, nil
+	targets = append(targets, opts)
+	return targets, nil
 }
 
-func delete(ctx context.Context, opts DeleteOptions) error {
+// config returns the S3 config for opts.DSN or, if it is empty, the DSN
+// environment variable.
+
+func config(opts DeleteOptions) (*s3.S3Config, error) {
 
 	if opts.DSN == "" {
 
 		dsn, ok := os.LookupEnv("DSN")
 
 		if !ok {
-			return errors.New("Missing DSN")
+			return nil, errors.New("Missing DSN")
 		}
 
 		opts.DSN = dsn
 	}
 
+	return s3.NewS3ConfigFromString(opts.DSN)
+}
+
+func connect(opts DeleteOptions) (*s3.S3Connection, error) {
+
+	cfg, err := config(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.NewS3Connection(cfg)
+}
+
+// list_objects returns the objects in the directory for opts.ID that are in its scope.
+
+func list_objects(conn *s3.S3Connection, opts DeleteOptions) ([]*s3.S3Object, error) {
+
 	if opts.ID == 0 {
-		return errors.New("Invalid ID")
+		return nil, errors.New("Invalid ID")
 	}
 
-	cfg, err := s3.NewS3ConfigFromString(opts.DSN)
+	scope, err := parseScope(opts.Scope)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	conn, err := s3.NewS3Connection(cfg)
+	path, err := uri.Id2Path(opts.ID)
 
-	// add hooks for alternative paths (fullname, etc.)
+	if err != nil {
+		return nil, err
+	}
 
-	path, err := uri.Id2Path(opts.ID)
+	objects := make([]*s3.S3Object, 0)
+	mu := new(sync.Mutex)
+
+	cb := func(obj *s3.S3Object) error {
+
+		ok, err := scope.matches(opts.ID, obj.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			mu.Lock()
+			objects = append(objects, obj)
+			mu.Unlock()
+		}
+
+		return nil
+	}
+
+	list_opts := s3.DefaultS3ListOptions()
+	list_opts.Path = path + "/"
+
+	err = conn.List(cb, list_opts)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if len(objects) == 0 {
+		log.Printf("Nothing to delete for %d in %s\n", opts.ID, path)
+	}
+
+	return objects, nil
+}
+
+// remove deletes, or quarantines if opts.Quarantine is set, objects.
+
+func remove(conn *s3.S3Connection, opts DeleteOptions, objects []*s3.S3Object, workers int) error {
+
+	if opts.Quarantine != "" {
+
+		q_conn, err := connect_quarantine(opts)
+
+		if err != nil {
+			return err
+		}
+
+		return quarantine(conn, q_conn, objects, opts.Dryrun, workers)
+	}
+
+	keys := make([]string, len(objects))
+
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+
+	return delete_keys(conn, keys, opts.Dryrun, workers)
+}
+
+// delete_keys logs every one of keys and then, unless dryrun is true, deletes
+// them in batches, running up to workers batches at a time. Keys that could
+// not be deleted are logged individually.
+
+func delete_keys(conn *s3.S3Connection, keys []string, dryrun bool, workers int) error {
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		if dryrun {
+			log.Println("[dryrun] DELETE", key)
+		} else {
+			log.Println("DELETE", key)
+		}
 	}
 
-	if opts.Dryrun {
-		log.Println("[dryrun] DELETE", path)
+	if dryrun || len(keys) == 0 {
 		return nil
 	}
 
-	return conn.DeleteRecursive(path)
+	failures := conn.DeleteMany(keys, workers)
+
+	for _, f := range failures {
+		log.Println("ERROR", f.Key, f.Code, f.Message)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to delete %d of %d keys", len(failures), len(keys))
+	}
+
+	return nil
+}
+
+// delete is the Lambda function, which deletes a single ID. Everything is
+// listed first so that exactly what is going to be deleted is logged before
+// anything actually is.
+
+func delete(ctx context.Context, opts DeleteOptions) error {
+
+	err := validate(opts)
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(opts)
+
+	if err != nil {
+		return err
+	}
+
+	if opts.versioned() {
+
+		versions, err := list_versions(conn, opts)
+
+		if err != nil {
+			return err
+		}
+
+		return remove_versions(conn, opts, versions, 1)
+	}
+
+	objects, err := list_objects(conn, opts)
+
+	if err != nil {
+		return err
+	}
+
+	return remove(conn, opts, objects, 1)
 }
 
 func main() {
 
 	dryrun := flag.Bool("dryrun", false, "Go through the motions but don't actually delete anything.")
 	stdin := flag.Bool("stdin", false, "Read IDs to delete from STDIN.")
+	scope := flag.String("scope", "all", "What to delete for each ID, as a comma-separated list of: all (everything in the ID's directory, including derived files), primary (the {ID}.geojson file), alt (every alternate geometry) or alt={LABEL} (a specific alternate geometry, for example alt=quattroshapes). It can be set for an individual ID like this: {ID}:{SCOPE}.")
+
+	quarantine_prefix := flag.String("quarantine", "", "If set, copy objects to this prefix (in the same bucket), recording their original key, ETag and the time in a manifest, before deleting them so that they can be put back with -restore.")
+	restore := flag.Bool("restore", false, "Put objects in the -quarantine prefix back where they came from, using its manifests. If no IDs are passed then everything is restored, otherwise only the objects for those IDs (and scopes).")
+	purge := flag.Bool("purge", false, "On versioned buckets, permanently delete every version of every object, including delete markers, rather than adding a delete marker. This can not be undone.")
+	do_undelete := flag.Bool("undelete", false, "On versioned buckets, bring back deleted objects by deleting their latest delete marker.")
+	acl := flag.String("acl", "public-read", "The ACL to apply to restored objects (S3 doesn't copy ACLs).")
+	force := flag.Bool("force", false, "Overwrite objects that exist when restoring them with -restore. By default they are left alone.")
+	workers := flag.Int("workers", 10, "The number of IDs to list, and batches of (up to 1000) keys to delete, concurrently.")
 
 	s3_dsn := flag.String("s3-dsn", "", "A valid go-whosonfirst-aws DSN string for talking to S3.")
 
@@ -101,8 +444,22 @@ func main() {
 	flag.Parse()
 
 	opts := DeleteOptions{
-		DSN:    *s3_dsn,
-		Dryrun: *dryrun,
+		DSN:        *s3_dsn,
+		Dryrun:     *dryrun,
+		Scope:      *scope,
+		Quarantine: *quarantine_prefix,
+		Purge:      *purge,
+		Undelete:   *do_undelete,
+	}
+
+	err := validate(opts)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *restore && opts.versioned() {
+		log.Fatal("Objects can not be purged or undeleted and restored at the same time")
 	}
 
 	_, do_lambda := os.LookupEnv("LAMBDA")
@@ -112,8 +469,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	ids := make([]int64, 0)
-	var err error
+	targets := make([]DeleteOptions, 0)
 
 	if *stdin {
 
@@ -121,7 +477,7 @@ func main() {
 
 		for scanner.Scan() {
 
-			ids, err = append_id(ids, scanner.Text())
+			targets, err = append_target(targets, opts, scanner.Text())
 
 			if err != nil {
 				log.Fatal(err)
@@ -130,9 +486,9 @@ func main() {
 
 	} else {
 
-		for _, str_id := range flag.Args() {
+		for _, str_target := range flag.Args() {
 
-			ids, err = append_id(ids, str_id)
+			targets, err = append_target(targets, opts, str_target)
 
 			if err != nil {
 				log.Fatal(err)
@@ -152,6 +508,10 @@ func main() {
 
 	if *do_invoke {
 
+		if *restore {
+			log.Fatal("Restoring objects can not be done using Lambda functions")
+		}
+
 		svc, err := lambda.NewLambdaServiceWithDSN(*lambda_dsn)
 
 		if err != nil {
@@ -166,11 +526,11 @@ func main() {
 			throttle <- true
 		}
 
-		for _, id := range ids {
+		for _, target := range targets {
 
 			wg.Add(1)
 
-			go func(svc *aws_lambda.Lambda, wg *sync.WaitGroup, throttle chan bool, id int64) {
+			go func(svc *aws_lambda.Lambda, wg *sync.WaitGroup, throttle chan bool, target DeleteOptions) {
 
 				<-throttle
 
@@ -179,34 +539,116 @@ func main() {
 					wg.Done()
 				}()
 
-				opts.ID = id
-
-				_, err := lambda.InvokeFunction(svc, *lambda_func, *lambda_type, opts)
+				_, err := lambda.InvokeFunction(svc, *lambda_func, *lambda_type, target)
 
 				if err != nil {
-					log.Println("ERROR", id, err)
+					log.Println("ERROR", target.ID, err)
 				}
 
-			}(svc, wg, throttle, id)
+			}(svc, wg, throttle, target)
 		}
 
 		wg.Wait()
 		os.Exit(0)
 	}
 
-	// nothing left but the command line
+	// nothing left but the command line: collect the keys for every ID
+	// first and then delete them all in batches
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	conn, err := connect(opts)
 
-	for _, id := range ids {
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	if *restore {
+
+		if *quarantine_prefix == "" {
+			log.Fatal("Restoring objects requires a -quarantine prefix")
+		}
+
+		q_conn, err := connect_quarantine(opts)
 
-		opts.ID = id
-		err := delete(ctx, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = restore_objects(conn, q_conn, targets, *acl, *force, *dryrun, *workers)
 
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		os.Exit(0)
+	}
+
+	objects := make([]*s3.S3Object, 0)
+	versions := make([]*s3.S3ObjectVersion, 0)
+	mu := new(sync.Mutex)
+
+	wg := new(sync.WaitGroup)
+	throttle := make(chan bool, *workers)
+
+	var list_err error
+
+	for _, target := range targets {
+
+		wg.Add(1)
+		throttle <- true
+
+		go func(target DeleteOptions) {
+
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+
+			var target_objects []*s3.S3Object
+			var target_versions []*s3.S3ObjectVersion
+			var err error
+
+			if target.versioned() {
+				target_versions, err = list_versions(conn, target)
+			} else {
+				target_objects, err = list_objects(conn, target)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+
+				if list_err == nil {
+					list_err = fmt.Errorf("Failed to list keys for %d because %s", target.ID, err)
+				}
+
+				return
+			}
+
+			objects = append(objects, target_objects...)
+			versions = append(versions, target_versions...)
+
+		}(target)
+	}
+
+	wg.Wait()
+
+	if list_err != nil {
+		log.Fatal(list_err)
+	}
+
+	if opts.versioned() {
+		err = remove_versions(conn, opts, versions, *workers)
+	} else {
+		err = remove(conn, opts, objects, *workers)
+	}
+
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	os.Exit(0)
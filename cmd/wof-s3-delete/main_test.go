@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const testBucket = "data.whosonfirst.org"
+
+// Tests run the tool by re-executing the test binary with WOF_S3_DELETE_MAIN
+// set, which causes TestMain to call main() with the arguments passed to it.
+
+func TestMain(m *testing.M) {
+
+	if os.Getenv("WOF_S3_DELETE_MAIN") != "" {
+		os.Args = append([]string{"wof-s3-delete"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func run(t *testing.T, stdin string, args ...string) string {
+
+	cmd := exec.Command(os.Args[0], args...)
+
+	cmd.Env = append(os.Environ(),
+		"WOF_S3_DELETE_MAIN=1",
+		"AWS_ACCESS_KEY_ID=fakes3",
+		"AWS_SECRET_ACCESS_KEY=fakes3",
+	)
+
+	cmd.Stdin = strings.NewReader(stdin)
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Failed to run wof-s3-delete %v, %s\n%s", args, err, out)
+	}
+
+	return string(out)
+}
+
+// runError is like run but expects wof-s3-delete to fail.
+
+func runError(t *testing.T, stdin string, args ...string) string {
+
+	cmd := exec.Command(os.Args[0], args...)
+
+	cmd.Env = append(os.Environ(),
+		"WOF_S3_DELETE_MAIN=1",
+		"AWS_ACCESS_KEY_ID=fakes3",
+		"AWS_SECRET_ACCESS_KEY=fakes3",
+	)
+
+	cmd.Stdin = strings.NewReader(stdin)
+
+	out, err := cmd.CombinedOutput()
+
+	if err == nil {
+		t.Fatalf("Expected wof-s3-delete %v to fail\n%s", args, out)
+	}
+
+	return string(out)
+}
+
+func testServer() *fakes3.Server {
+
+	srv := fakes3.NewServer(testBucket)
+
+	keys := []string{
+		"data/115/932/484/9/1159324849.geojson",
+		"data/115/932/484/9/1159324849-alt-quattroshapes.geojson",
+		"data/115/932/484/9/1159324849.jpg",
+		"data/115/932/484/90/11593248490.geojson",
+		"data/101/736/545/101736545.geojson",
+	}
+
+	for _, k := range keys {
+		srv.PutObject(testBucket, k, []byte(`{}`))
+	}
+
+	return srv
+}
+
+func TestDelete(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	run(t, "", "-s3-dsn", srv.DSN(testBucket, "data"), "1159324849")
+
+	keys := srv.Keys(testBucket)
+
+	if len(keys) != 2 || keys[0] != "data/101/736/545/101736545.geojson" || keys[1] != "data/115/932/484/90/11593248490.geojson" {
+		t.Fatalf("Unexpected keys after delete: %v", keys)
+	}
+}
+
+func TestDeleteStdin(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	run(t, "1159324849\n101736545\n11593248490\n", "-s3-dsn", srv.DSN(testBucket, "data"), "-stdin")
+
+	keys := srv.Keys(testBucket)
+
+	if len(keys) != 0 {
+		t.Fatalf("Unexpected keys after delete: %v", keys)
+	}
+}
+
+func TestDeleteDryrun(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	out := run(t, "", "-s3-dsn", srv.DSN(testBucket, "data"), "-dryrun", "1159324849")
+
+	if len(srv.Keys(testBucket)) != 5 {
+		t.Fatalf("Expected nothing to be deleted but got %v", srv.Keys(testBucket))
+	}
+
+	if !strings.Contains(out, "115/932/484/9") {
+		t.Fatalf("Expected dryrun output to include path: %s", out)
+	}
+}
+
+func TestDeleteScope(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	run(t, "", "-s3-dsn", srv.DSN(testBucket, "data"), "-scope", "primary", "1159324849")
+
+	keys := srv.Keys(testBucket)
+
+	if len(keys) != 4 || srv.Object(testBucket, "data/115/932/484/9/1159324849.geojson") != nil {
+		t.Fatalf("Expected only the primary record to be deleted but got %v", keys)
+	}
+
+	// scopes for individual IDs take precedence over -scope
+
+	out := run(t, "1159324849:alt=quattroshapes\n101736545\n", "-s3-dsn", srv.DSN(testBucket, "data"), "-scope", "primary", "-stdin")
+
+	keys = srv.Keys(testBucket)
+
+	if len(keys) != 2 || keys[0] != "data/115/932/484/9/1159324849.jpg" || keys[1] != "data/115/932/484/90/11593248490.geojson" {
+		t.Fatalf("Unexpected keys after delete: %v", keys)
+	}
+
+	if !strings.Contains(out, "DELETE 115/932/484/9/1159324849-alt-quattroshapes.geojson") {
+		t.Fatalf("Expected output to list deleted keys: %s", out)
+	}
+}
+
+func TestDeleteInvalidScope(t *testing.T) {
+
+	cmd := exec.Command(os.Args[0], "-s3-dsn", "bucket=example region=us-east-1", "-scope", "primary,alt=", "1159324849")
+	cmd.Env = append(os.Environ(), "WOF_S3_DELETE_MAIN=1")
+
+	err := cmd.Run()
+
+	if err == nil {
+		t.Fatal("Expected an invalid scope to fail")
+	}
+}
+
+func TestDeleteBatches(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	for i := 0; i < 2500; i++ {
+		srv.PutObject(testBucket, fmt.Sprintf("data/101/736/545/101736545-%d.png", i), []byte(`{}`))
+	}
+
+	srv.FailDelete(testBucket, "data/101/736/545/101736545-42.png", "AccessDenied")
+
+	cmd := exec.Command(os.Args[0], "-s3-dsn", srv.DSN(testBucket, "data"), "1159324849", "101736545")
+
+	cmd.Env = append(os.Environ(),
+		"WOF_S3_DELETE_MAIN=1",
+		"AWS_ACCESS_KEY_ID=fakes3",
+		"AWS_SECRET_ACCESS_KEY=fakes3",
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	if err == nil {
+		t.Fatal("Expected delete to fail")
+	}
+
+	if !strings.Contains(string(out), "ERROR 101/736/545/101736545-42.png AccessDenied") {
+		t.Fatalf("Expected the key that could not be deleted to be reported: %s", out)
+	}
+
+	// 2501 keys for 101736545 and 3 for 1159324849, in batches of 1000
+
+	if srv.Requests("POST") != 3 {
+		t.Fatalf("Expected 3 DeleteObjects requests but got %d", srv.Requests("POST"))
+	}
+
+	keys := srv.Keys(testBucket)
+
+	if len(keys) != 2 || keys[0] != "data/101/736/545/101736545-42.png" || keys[1] != "data/115/932/484/90/11593248490.geojson" {
+		t.Fatalf("Unexpected keys after delete: %v", keys)
+	}
+}
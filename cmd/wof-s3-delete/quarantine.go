@@ -0,0 +1,433 @@
+package main
+
+// Quarantining is a soft delete: objects are copied (server-side) to a
+// quarantine prefix, in the same bucket, and a manifest recording where they
+// came from is written there before the originals are deleted. Each run (or
+// Lambda invocation) has its own ID, the time it started in nanoseconds, and
+// writes its objects below {QUARANTINE}/{RUN ID} and its manifest to
+// {QUARANTINE}/manifest-{RUN ID}.json, so quarantining the same thing twice
+// never overwrites anything. Quarantined objects keep their relative keys,
+// so 115/932/484/9/1159324849.geojson in the "data" prefix ends up as
+// {QUARANTINE}/{RUN ID}/115/932/484/9/1159324849.geojson. Restoring copies
+// them back, using the same DSN, and removes them (and their manifest
+// entries) from the quarantine prefix. Objects that exist again by the time
+// they are restored are left alone unless restoring is forced.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type QuarantineManifest struct {
+	Source  string             `json:"source"` // the URI of the prefix that objects were quarantined from
+	Created time.Time          `json:"created"`
+	Entries []*QuarantineEntry `json:"entries"`
+}
+
+type QuarantineEntry struct {
+	Key           string    `json:"key"`            // the original key, relative to the source
+	QuarantineKey string    `json:"quarantine_key"` // the key of the quarantined copy, relative to the quarantine prefix
+	ETag          string    `json:"etag"`
+	Size          int64     `json:"size"`
+	LastModified  time.Time `json:"last_modified"`
+	Quarantined   time.Time `json:"quarantined"`
+}
+
+// connect_quarantine returns a new S3 connection for the same bucket as
+// opts.DSN but with opts.Quarantine as its prefix. The two prefixes can't
+// overlap: quarantined records inside the DSN prefix would look like (stray)
+// records to things like wof-s3-sync -delete, which might delete them, and a
+// DSN prefix inside the quarantine prefix would mean quarantining records
+// in to the middle of the data being quarantined.
+
+func connect_quarantine(opts DeleteOptions) (*s3.S3Connection, error) {
+
+	cfg, err := config(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(opts.Quarantine, "/")
+
+	if prefix == "" {
+		return nil, errors.New("Invalid quarantine prefix")
+	}
+
+	dsn_prefix := strings.Trim(cfg.Prefix, "/")
+
+	if dsn_prefix == "" {
+		return nil, errors.New("Quarantining requires a DSN with a prefix, otherwise the quarantine prefix would be inside it")
+	}
+
+	if prefix == dsn_prefix || strings.HasPrefix(prefix, dsn_prefix+"/") || strings.HasPrefix(dsn_prefix, prefix+"/") {
+		return nil, fmt.Errorf("The quarantine prefix (%s) can not be the same as, be inside or contain the DSN prefix (%s)", prefix, dsn_prefix)
+	}
+
+	cfg.Prefix = prefix
+	return s3.NewS3Connection(cfg)
+}
+
+// quarantine copies objects from conn to q_conn, writes a manifest for the
+// objects that were copied successfully and then deletes them from conn.
+// Objects that could not be copied are left alone.
+
+func quarantine(conn *s3.S3Connection, q_conn *s3.S3Connection, objects []*s3.S3Object, dryrun bool, workers int) error {
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	run_id := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	for _, obj := range objects {
+
+		q_key := path.Join(run_id, obj.Key)
+
+		if dryrun {
+			log.Println("[dryrun] QUARANTINE", obj.Key, q_conn.URI(q_key))
+		} else {
+			log.Println("QUARANTINE", obj.Key, q_conn.URI(q_key))
+		}
+	}
+
+	if dryrun || len(objects) == 0 {
+		return nil
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	entries := make([]*QuarantineEntry, 0)
+	failed := 0
+
+	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	throttle := make(chan bool, workers)
+
+	for _, obj := range objects {
+
+		wg.Add(1)
+		throttle <- true
+
+		go func(obj *s3.S3Object) {
+
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+
+			q_key := path.Join(run_id, obj.Key)
+
+			_, err := q_conn.Copy(conn, obj.Key, q_key, nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				log.Println("ERROR", obj.Key, err)
+				failed += 1
+				return
+			}
+
+			e := QuarantineEntry{
+				Key:           obj.Key,
+				QuarantineKey: q_key,
+				ETag:          obj.ETag,
+				Size:          obj.Size,
+				LastModified:  obj.LastModified,
+				Quarantined:   time.Now(),
+			}
+
+			entries = append(entries, &e)
+
+		}(obj)
+	}
+
+	wg.Wait()
+
+	if len(entries) > 0 {
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Key < entries[j].Key
+		})
+
+		m := QuarantineManifest{
+			Source:  conn.URI(""),
+			Created: time.Now(),
+			Entries: entries,
+		}
+
+		name := fmt.Sprintf("manifest-%s.json", run_id)
+
+		// if the manifest can't be written nothing is deleted
+
+		err := write_manifest(q_conn, name, &m)
+
+		if err != nil {
+			return fmt.Errorf("Failed to write quarantine manifest because %s", err)
+		}
+
+		log.Println("Wrote quarantine manifest", q_conn.URI(name))
+
+		keys := make([]string, len(entries))
+
+		for i, e := range entries {
+			keys[i] = e.Key
+		}
+
+		err = delete_keys(conn, keys, false, workers)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to quarantine %d of %d objects", failed, len(objects))
+	}
+
+	return nil
+}
+
+// restore_objects copies quarantined objects in q_conn back to conn. If targets
+// is empty everything is restored, otherwise only the objects in the scope of
+// one of targets. Objects that are restored are removed from the quarantine
+// prefix and their manifests. Unless force is true objects that exist in conn
+// are not overwritten, and count as failures.
+
+func restore_objects(conn *s3.S3Connection, q_conn *s3.S3Connection, targets []DeleteOptions, acl string, force bool, dryrun bool, workers int) error {
+
+	names := make([]string, 0)
+	mu := new(sync.Mutex)
+
+	cb := func(obj *s3.S3Object) error {
+
+		if filepath.Ext(obj.Key) == ".json" && !strings.Contains(obj.Key, "/") {
+			mu.Lock()
+			names = append(names, obj.Key)
+			mu.Unlock()
+		}
+
+		return nil
+	}
+
+	list_opts := s3.DefaultS3ListOptions()
+	list_opts.Path = "manifest-"
+
+	err := q_conn.List(cb, list_opts)
+
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		log.Println("Nothing to restore in", q_conn.URI(""))
+		return nil
+	}
+
+	sort.Strings(names)
+
+	failed := 0
+
+	for _, name := range names {
+
+		m, err := read_manifest(q_conn, name)
+
+		if err != nil {
+			return fmt.Errorf("Failed to read %s because %s", name, err)
+		}
+
+		remaining := make([]*QuarantineEntry, 0)
+		restored := make([]string, 0)
+
+		for _, e := range m.Entries {
+
+			ok, err := restore_entry(e, targets)
+
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				remaining = append(remaining, e)
+				continue
+			}
+
+			if !force {
+
+				_, err := conn.Head(e.Key)
+
+				if err == nil {
+					log.Println("ERROR", e.Key, "already exists, not restoring it (use -force to overwrite it)")
+					remaining = append(remaining, e)
+					failed += 1
+					continue
+				}
+
+				if !s3.IsNotFound(err) {
+					log.Println("ERROR", e.Key, err)
+					remaining = append(remaining, e)
+					failed += 1
+					continue
+				}
+			}
+
+			if dryrun {
+				log.Println("[dryrun] RESTORE", e.Key)
+				remaining = append(remaining, e)
+				continue
+			}
+
+			log.Println("RESTORE", e.Key)
+
+			put_opts := s3.S3PutOptions{
+				ACL: acl,
+			}
+
+			etag, err := conn.Copy(q_conn, e.QuarantineKey, e.Key, &put_opts)
+
+			if err != nil {
+				log.Println("ERROR", e.Key, err)
+				remaining = append(remaining, e)
+				failed += 1
+				continue
+			}
+
+			// ETags for multipart uploads, and encrypted objects, aren't
+			// MD5 hashes so they can change even if the content hasn't
+
+			if etag != e.ETag {
+				log.Printf("Restored %s but its ETag has changed (from %s to %s)\n", e.Key, e.ETag, etag)
+			}
+
+			restored = append(restored, e.QuarantineKey)
+		}
+
+		if len(restored) == 0 {
+			continue
+		}
+
+		if len(remaining) == 0 {
+
+			err = q_conn.Delete(name)
+
+		} else {
+
+			m.Entries = remaining
+			err = write_manifest(q_conn, name, m)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to update %s because %s", name, err)
+		}
+
+		failures := q_conn.DeleteMany(restored, workers)
+
+		for _, f := range failures {
+			log.Println("ERROR", f.Key, f.Code, f.Message)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to restore %d objects", failed)
+	}
+
+	return nil
+}
+
+// restore_entry reports whether e should be restored for targets.
+
+func restore_entry(e *QuarantineEntry, targets []DeleteOptions) (bool, error) {
+
+	if len(targets) == 0 {
+		return true, nil
+	}
+
+	for _, t := range targets {
+
+		path, err := uri.Id2Path(t.ID)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !strings.HasPrefix(e.Key, path+"/") {
+			continue
+		}
+
+		scope, err := parseScope(t.Scope)
+
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := scope.matches(t.ID, e.Key)
+
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// read_manifest reads the manifest called name from conn, which must record
+// both the original and the quarantine key of every entry.
+
+func read_manifest(conn *s3.S3Connection, name string) (*QuarantineManifest, error) {
+
+	fh, err := conn.Get(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fh.Close()
+
+	var m QuarantineManifest
+
+	err = json.NewDecoder(fh).Decode(&m)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range m.Entries {
+
+		if e.Key == "" || e.QuarantineKey == "" {
+			return nil, fmt.Errorf("Invalid manifest entry, missing key or quarantine key: %+v", e)
+		}
+	}
+
+	return &m, nil
+}
+
+func write_manifest(conn *s3.S3Connection, name string, m *QuarantineManifest) error {
+
+	body, err := json.MarshalIndent(m, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Put(name, ioutil.NopCloser(bytes.NewReader(body)), nil)
+}
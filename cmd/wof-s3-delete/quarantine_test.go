@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	dsn := srv.DSN(testBucket, "data")
+	primary := "data/115/932/484/9/1159324849.geojson"
+
+	etag := srv.Object(testBucket, primary).ETag
+
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "1159324849")
+
+	if srv.Object(testBucket, primary) != nil {
+		t.Fatalf("Expected %s to be deleted", primary)
+	}
+
+	manifest := ""
+
+	for _, k := range srv.Keys(testBucket) {
+
+		if strings.HasPrefix(k, "quarantine/manifest-") {
+			manifest = k
+		}
+	}
+
+	if manifest == "" {
+		t.Fatalf("Missing quarantine manifest: %v", srv.Keys(testBucket))
+	}
+
+	var m QuarantineManifest
+
+	err := json.Unmarshal(srv.Object(testBucket, manifest).Body, &m)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Entries) != 3 || m.Entries[0].Key != "115/932/484/9/1159324849-alt-quattroshapes.geojson" || m.Entries[1].ETag != etag {
+		t.Fatalf("Unexpected manifest entries: %s", srv.Object(testBucket, manifest).Body)
+	}
+
+	run_id := strings.TrimSuffix(strings.TrimPrefix(manifest, "quarantine/manifest-"), ".json")
+	q_primary := "quarantine/" + run_id + "/115/932/484/9/1159324849.geojson"
+
+	if m.Entries[1].QuarantineKey != run_id+"/115/932/484/9/1159324849.geojson" {
+		t.Fatalf("Unexpected quarantine key: %s", m.Entries[1].QuarantineKey)
+	}
+
+	if srv.Object(testBucket, q_primary) == nil {
+		t.Fatal("Expected primary record to be quarantined")
+	}
+
+	// restore just the primary record
+
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "-restore", "1159324849:primary")
+
+	obj := srv.Object(testBucket, primary)
+
+	if obj == nil || obj.ETag != etag || obj.ACL != "public-read" {
+		t.Fatalf("Expected %s to be restored: %+v", primary, obj)
+	}
+
+	if srv.Object(testBucket, q_primary) != nil {
+		t.Fatal("Expected restored record to be removed from quarantine")
+	}
+
+	// and then everything else
+
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "-restore")
+
+	keys := srv.Keys(testBucket)
+
+	if len(keys) != 5 {
+		t.Fatalf("Expected everything to be restored but got %v", keys)
+	}
+
+	for _, k := range keys {
+
+		if strings.HasPrefix(k, "quarantine/") {
+			t.Fatalf("Unexpected key left in quarantine: %s", k)
+		}
+	}
+}
+
+func TestQuarantineTwice(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	dsn := srv.DSN(testBucket, "data")
+	primary := "data/115/932/484/9/1159324849.geojson"
+
+	srv.PutObject(testBucket, primary, []byte(`{"v":1}`))
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "1159324849:primary")
+
+	srv.PutObject(testBucket, primary, []byte(`{"v":2}`))
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "1159324849:primary")
+
+	quarantined := make([]string, 0)
+
+	for _, k := range srv.Keys(testBucket) {
+
+		if strings.HasPrefix(k, "quarantine/") && strings.HasSuffix(k, "/115/932/484/9/1159324849.geojson") {
+			quarantined = append(quarantined, k)
+		}
+	}
+
+	if len(quarantined) != 2 {
+		t.Fatalf("Expected both copies to be quarantined but got %v", srv.Keys(testBucket))
+	}
+
+	// a live object is never overwritten without -force
+
+	srv.PutObject(testBucket, primary, []byte(`{"v":3}`))
+
+	runError(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "-restore", "1159324849:primary")
+
+	if string(srv.Object(testBucket, primary).Body) != `{"v":3}` {
+		t.Fatalf("Expected %s not to be overwritten", primary)
+	}
+
+	for _, k := range quarantined {
+
+		if srv.Object(testBucket, k) == nil {
+			t.Fatalf("Expected %s to stay quarantined", k)
+		}
+	}
+
+	// with -force manifests are restored oldest first so the newest copy wins
+
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "-restore", "-force", "1159324849:primary")
+
+	if string(srv.Object(testBucket, primary).Body) != `{"v":2}` {
+		t.Fatalf("Expected %s to be restored from the latest quarantine: %s", primary, srv.Object(testBucket, primary).Body)
+	}
+
+	for _, k := range srv.Keys(testBucket) {
+
+		if strings.HasPrefix(k, "quarantine/") {
+			t.Fatalf("Unexpected key left in quarantine: %s", k)
+		}
+	}
+}
+
+func TestRestoreInvalidManifest(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	dsn := srv.DSN(testBucket, "data")
+	primary := "data/115/932/484/9/1159324849.geojson"
+
+	run(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "1159324849:primary")
+
+	manifest := `{"entries":[{"key":"115/932/484/9/1159324849.geojson"}]}`
+	srv.PutObject(testBucket, "quarantine/manifest-0.json", []byte(manifest))
+
+	out := runError(t, "", "-s3-dsn", dsn, "-quarantine", "quarantine", "-restore")
+
+	if !strings.Contains(out, "missing key or quarantine key") {
+		t.Fatalf("Unexpected output: %s", out)
+	}
+
+	if srv.Object(testBucket, primary) != nil {
+		t.Fatalf("Expected %s not to be restored", primary)
+	}
+}
+
+func TestQuarantinePrefix(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	tests := map[string]string{
+		"data/quarantine": "data",
+		"data":            "data",
+		"quarantine":      "",
+		"archive":         "archive/data",
+	}
+
+	for q, prefix := range tests {
+
+		runError(t, "", "-s3-dsn", srv.DSN(testBucket, prefix), "-quarantine", q, "1159324849")
+
+		if len(srv.Keys(testBucket)) != 5 {
+			t.Fatalf("Expected nothing to be quarantined with -quarantine '%s' and prefix '%s' but got %v", q, prefix, srv.Keys(testBucket))
+		}
+	}
+}
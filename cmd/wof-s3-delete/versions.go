@@ -0,0 +1,133 @@
+package main
+
+/*
+
+On versioned buckets deleting an object only adds a delete marker, which
+hides it, and every previous version of it is kept. With -purge every
+version of every key (in scope) for an ID, delete markers included, is
+deleted permanently. With -undelete the latest delete marker for every
+key (in scope) is deleted instead, which brings back the version before
+it. Neither can be undone. Use wof-s3-versions to see what's there.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"log"
+)
+
+// list_versions returns every version, including delete markers, of the
+// objects in the directory for opts.ID that are in its scope.
+
+func list_versions(conn *s3.S3Connection, opts DeleteOptions) ([]*s3.S3ObjectVersion, error) {
+
+	if opts.ID == 0 {
+		return nil, errors.New("Invalid ID")
+	}
+
+	scope, err := parseScope(opts.Scope)
+
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := uri.Id2Path(opts.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]*s3.S3ObjectVersion, 0)
+
+	cb := func(v *s3.S3ObjectVersion) error {
+
+		ok, err := scope.matches(opts.ID, v.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			versions = append(versions, v)
+		}
+
+		return nil
+	}
+
+	list_opts := s3.DefaultS3ListOptions()
+	list_opts.Path = path + "/"
+
+	err = conn.ListVersions(cb, list_opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		log.Printf("No versions for %d in %s\n", opts.ID, path)
+	}
+
+	return versions, nil
+}
+
+// remove_versions purges or, if opts.Undelete is true, undeletes versions.
+
+func remove_versions(conn *s3.S3Connection, opts DeleteOptions, versions []*s3.S3ObjectVersion, workers int) error {
+
+	if opts.Undelete {
+		return undelete(conn, versions, opts.Dryrun, workers)
+	}
+
+	return delete_versions(conn, "PURGE", versions, opts.Dryrun, workers)
+}
+
+// undelete deletes the latest version of every key in versions, if it is a
+// delete marker.
+
+func undelete(conn *s3.S3Connection, versions []*s3.S3ObjectVersion, dryrun bool, workers int) error {
+
+	markers := make([]*s3.S3ObjectVersion, 0)
+
+	for _, v := range versions {
+
+		if v.IsLatest && v.DeleteMarker {
+			markers = append(markers, v)
+		}
+	}
+
+	return delete_versions(conn, "UNDELETE", markers, dryrun, workers)
+}
+
+// delete_versions is like delete_keys but for specific versions, which are
+// logged with label.
+
+func delete_versions(conn *s3.S3Connection, label string, versions []*s3.S3ObjectVersion, dryrun bool, workers int) error {
+
+	for _, v := range versions {
+
+		if dryrun {
+			log.Println("[dryrun]", label, v.Key, v.VersionId)
+		} else {
+			log.Println(label, v.Key, v.VersionId)
+		}
+	}
+
+	if dryrun || len(versions) == 0 {
+		return nil
+	}
+
+	failures := conn.DeleteVersions(versions, workers)
+
+	for _, f := range failures {
+		log.Println("ERROR", f.Key, f.VersionId, f.Code, f.Message)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to delete %d of %d versions", len(failures), len(versions))
+	}
+
+	return nil
+}
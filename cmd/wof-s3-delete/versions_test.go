@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPurgeAndUndelete(t *testing.T) {
+
+	srv := testServer()
+	defer srv.Close()
+
+	srv.EnableVersioning(testBucket)
+
+	dsn := srv.DSN(testBucket, "data")
+	primary := "data/115/932/484/9/1159324849.geojson"
+	alt := "data/115/932/484/9/1159324849-alt-quattroshapes.geojson"
+
+	srv.PutObject(testBucket, primary, []byte(`{"v":2}`))
+
+	// on a versioned bucket deleting only adds delete markers
+
+	run(t, "", "-s3-dsn", dsn, "1159324849")
+
+	if srv.Object(testBucket, primary) != nil {
+		t.Fatalf("Expected %s to be deleted", primary)
+	}
+
+	if len(srv.Versions(testBucket, primary)) != 3 {
+		t.Fatalf("Expected 2 versions and a delete marker for %s", primary)
+	}
+
+	out := run(t, "", "-s3-dsn", dsn, "-undelete", "-dryrun", "1159324849:primary")
+
+	if !strings.Contains(out, "[dryrun] UNDELETE 115/932/484/9/1159324849.geojson") || srv.Object(testBucket, primary) != nil {
+		t.Fatalf("Unexpected dryrun output: %s", out)
+	}
+
+	run(t, "", "-s3-dsn", dsn, "-undelete", "1159324849:primary")
+
+	obj := srv.Object(testBucket, primary)
+
+	if obj == nil || string(obj.Body) != `{"v":2}` {
+		t.Fatalf("Expected the latest version of %s to be undeleted: %+v", primary, obj)
+	}
+
+	if srv.Object(testBucket, alt) != nil {
+		t.Fatalf("Expected %s to stay deleted", alt)
+	}
+
+	// undeleting something that isn't deleted does nothing
+
+	run(t, "", "-s3-dsn", dsn, "-undelete", "1159324849:primary")
+
+	if len(srv.Versions(testBucket, primary)) != 2 {
+		t.Fatalf("Expected 2 versions of %s", primary)
+	}
+
+	run(t, "", "-s3-dsn", dsn, "-purge", "1159324849:primary,alt")
+
+	if srv.Object(testBucket, primary) != nil || len(srv.Versions(testBucket, primary)) != 0 || len(srv.Versions(testBucket, alt)) != 0 {
+		t.Fatalf("Expected every version of %s and %s to be purged", primary, alt)
+	}
+
+	if len(srv.Versions(testBucket, "data/115/932/484/9/1159324849.jpg")) != 2 {
+		t.Fatal("Expected versions outside the scope to be kept")
+	}
+}
@@ -1,31 +1,156 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/aaronland/go-string/dsn"
 	"github.com/whosonfirst/go-whosonfirst-index"
 	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-s3/metrics"
 	"github.com/whosonfirst/go-whosonfirst-s3/sync"
+	"github.com/whosonfirst/go-whosonfirst-s3/throttle"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// pull copies everything in the bucket (and prefix) defined by dsn in to the
+// path passed on the command line. If mode is "repo" then records are written
+// to the repo's "data" directory (mirroring the way the repo indexer works).
+
+func pull(opts sync.LocalSyncOptions, mode string) {
+
+	logger := opts.Logger
+
+	args := flag.Args()
+
+	if len(args) != 1 {
+		logger.Fatal("Pulling data requires a single local path")
+	}
+
+	root := args[0]
+
+	switch mode {
+	case "repo":
+		root = filepath.Join(root, "data")
+	case "directory":
+		// pass
+	default:
+		logger.Fatal("Pulling data only supports the repo and directory modes")
+	}
+
+	opts.Root = root
+
+	ls, err := sync.NewLocalSync(opts)
+
+	if err != nil {
+		logger.Fatal("Failed to create new sync because %s", err)
+	}
+
+	t1 := time.Now()
+
+	err = ls.SyncRemote()
+
+	if err != nil {
+		logger.Fatal("Failed to pull %s because %s", root, err)
+	}
+
+	logger.Status("time to pull %s : %v\n", root, time.Since(t1))
+}
+
+// count_files returns the number of files (anything that isn't a directory)
+// in root and its subdirectories.
+
+func count_files(root string) (int64, error) {
+
+	count := int64(0)
+
+	cb := func(path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			count += 1
+		}
+
+		return nil
+	}
+
+	err := filepath.Walk(root, cb)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// pathTiming is the time it took to index a path, for the -report file.
+
+type pathTiming struct {
+	path     string
+	duration time.Duration
+	indexed  int64
+	err      error
+}
+
 func main() {
 
 	valid_modes := strings.Join(index.Modes(), ",")
 	desc_modes := fmt.Sprintf("The mode to use for reading local data. Valid modes are: %s.", valid_modes)
 
 	var mode = flag.String("mode", "repo", desc_modes)
+	var direction = flag.String("direction", "push", "The direction to sync data in. Valid directions are: push (local -> S3), pull (S3 -> local).")
 	var region = flag.String("region", "us-east-1", "The region your S3 bucket lives in.")
 	var bucket = flag.String("bucket", "data.whosonfirst.org", "The name of your S3 bucket.")
 	var prefix = flag.String("prefix", "", "The prefix (or subdirectory) for syncing data")
 	var credentials = flag.String("credentials", "iam:", "What kind of AWS credentials to use for syncing data.")
-	var dsn = flag.String("dsn", "", "A valid go-whosonfirst-aws DSN string.")
+	var str_dsn = flag.String("dsn", "", "A valid go-whosonfirst-aws DSN string.")
+	var endpoint = flag.String("endpoint", "", "A custom endpoint for an S3-compatible service (for example MinIO or Ceph RGW) like http://localhost:9000.")
+	var path_style = flag.Bool("path-style", false, "Use path-style (rather than virtual host) addressing for S3 requests. This is usually necessary for S3-compatible services.")
+	var disable_ssl = flag.Bool("disable-ssl", false, "Disable SSL when talking to S3.")
+	var part_size = flag.Int64("part-size", 0, "The size, in bytes, of each part when uploading large files in multiple parts. This is also used to check whether multipart uploads have changed. If 0 the aws-sdk-go default (5MB) is used.")
+	var target = flag.String("target", "", "A URI for the target to sync with, for example s3://{BUCKET}/{PREFIX}?region={REGION}, file:///{PATH} or mem://. If set this takes precedence over -dsn.")
+	var sse = flag.String("sse", "", "The server-side encryption to apply to uploads. Valid options are: AES256 (SSE-S3), aws:kms (SSE-KMS).")
+	var sse_kms_key_id = flag.String("sse-kms-key-id", "", "The ID of the KMS key to use with the aws:kms server-side encryption. If empty the default AWS managed key is used.")
+	var sse_c_key_file = flag.String("sse-c-key-file", "", "The path to a file containing a 256-bit key (raw or base64 encoded) for customer-provided server-side encryption (SSE-C).")
 	var acl = flag.String("acl", "public-read", "A valid AWS S3 ACL string for permissions.")
-	var ratelimit = flag.Int("rate-limit", 100000, "The maximum number or concurrent processes.")
+	var ratelimit = flag.Int("rate-limit", 100000, "The maximum number of files to sync (or delete) per minute. 0 means no limit.")
+	var max_in_flight = flag.Int("max-in-flight", 0, "The maximum number of concurrent uploads. 0 means no limit.")
+	var requests_per_sec = flag.Int("requests-per-second", 0, "The maximum number of requests (HEAD, PUT or DELETE) to make per second. 0 means no limit.")
+	var adaptive = flag.Bool("adaptive-throttle", false, "Adjust the -requests-per-second limit (or 100 requests per second if it is 0) according to how S3 responds, halving it when S3 asks us to slow down and slowly increasing it again, up to the limit, after a run of successful requests.")
+	var throttle_uri = flag.String("throttle-uri", "", "A URI like redis://{HOST}:{PORT}/{KEY} for a Redis server used to share the -requests-per-second limit (or 100 requests per second if it is 0) between every process using the same server and key.")
+	var bytes_per_sec = flag.Int64("bytes-per-second", 0, "The maximum number of bytes to upload per second. 0 means no limit.")
+	var max_attempts = flag.Int("retry-attempts", 5, "The maximum number of times to try syncing a file that fails with a retryable (throttling, timeout or server) error.")
+	var backoff = flag.Duration("retry-backoff", 1*time.Second, "The amount of time to wait before retrying failed files. This is doubled after each round of retries.")
+	var report_file = flag.String("report", "", "If set, write a JSON report summarizing the sync (counts, bytes uploaded, per-path timings, failures and the effective options) to this file once it is complete.")
+	var since = flag.String("since", "", "If set, only sync the WOF records that were changed between this commit (or anything else git understands, like HEAD~1 or a tag) and -until in each of the git repos passed on the command line, and delete the remote records for files that were deleted. Records are read from the git repos directly. This requires -mode repo.")
+	var until = flag.String("until", "HEAD", "The commit to sync up to when -since is set.")
+	var checkpoint = flag.String("checkpoint", "", "The path to a checkpoint file, recording which files have been confirmed synced (and the git commit of each repo in repo mode), which is updated as the sync runs. If the sync dies, or is interrupted, restarting it with the same checkpoint skips files that were already synced, unless -force is set or the commit has changed. The file is removed once a sync completes successfully.")
+	var checkpoint_interval = flag.Duration("checkpoint-interval", sync.DefaultCheckpointInterval, "How often to write synced files to the -checkpoint file.")
+	var resume_file = flag.String("resume-file", "", "If the sync is interrupted (by SIGINT or SIGTERM) write the paths of files that were in progress, had failed or were waiting to be retried to this file. Files that hadn't been reached yet are not included: resume the sync by running it again with the same -checkpoint (or -manifest). If empty a temporary file is created.")
+	var failures_file = flag.String("retry-failures", "", "If set, write the paths of files that could not be synced to this file. It can be fed back in to a later sync using the \"filelist\" mode.")
+	var prune = flag.Bool("delete", false, "Delete remote WOF records that do not exist locally, once all the local files have been synced. This requires -mode repo.")
+	var max_deletes = flag.Int("delete-max", 1000, "The maximum number of remote files that -delete is allowed to remove. If there are more than this nothing is deleted. A negative value means no limit.")
+	var manifest = flag.String("manifest", "", "The path to a local manifest file which is used to decide whether files have changed, instead of asking S3. It is created if it does not exist and updated once syncing is complete.")
+	var manifest_key = flag.String("manifest-key", "", "The key for a manifest file stored in the target (bucket and prefix) itself. If -manifest is also set and exists locally it takes precedence when reading the manifest.")
+	var rebuild_manifest = flag.Bool("rebuild-manifest", false, "Rebuild the manifest from a listing of the target before syncing. If no paths are passed on the command line the manifest is saved and nothing else happens.")
+	var compress = flag.String("compress", "", "Compress files before uploading them and set their Content-Encoding header accordingly. Valid options are: gzip, br.")
+	var rules_file = flag.String("rules", "", "The path to a JSON file containing rules that assign Cache-Control, Content-Type, Content-Disposition, ACL, storage class and tag settings to keys matching a pattern.")
+	var metrics_addr = flag.String("metrics-addr", "", "If set, serve Prometheus metrics (requests, bytes uploaded, throttle waits, errors and uploads in flight) at http://{ADDRESS}/metrics, for example localhost:9090.")
+	var prefetch = flag.Bool("prefetch", false, "List everything in the target (in parallel) before syncing and use that, rather than HEAD requests, to decide whether files have changed.")
 	var dryrun = flag.Bool("dryrun", false, "Go through the motions but don't actually sync anything.")
 	var force = flag.Bool("force", false, "Sync local files even if they haven't changed remotely.")
 	var verbose = flag.Bool("verbose", false, "Be chatty.")
@@ -39,20 +164,290 @@ func main() {
 		logger.AddLogger(stdout, "status")
 	}
 
-	if *dsn == "" {
-		*dsn = fmt.Sprintf("bucket=%s prefix=%s region=%s credentials=%s", *bucket, *prefix, *region, *credentials)
+	if *str_dsn == "" {
+		*str_dsn = fmt.Sprintf("bucket=%s prefix=%s region=%s credentials=%s", *bucket, *prefix, *region, *credentials)
+	}
+
+	// the -endpoint, -path-style, -disable-ssl and -part-size flags are appended
+	// to the DSN, or the query parameters of an s3:// -target, unless it already
+	// defines them in which case the DSN (or target) wins
+
+	extras := make(map[string]string)
+
+	if *endpoint != "" {
+		extras["endpoint"] = *endpoint
+	}
+
+	if *path_style {
+		extras["path-style"] = "true"
+	}
+
+	if *disable_ssl {
+		extras["disable-ssl"] = "true"
+	}
+
+	if *part_size != 0 {
+		extras["part-size"] = strconv.FormatInt(*part_size, 10)
+	}
+
+	if len(extras) > 0 && *target != "" {
+
+		u, err := url.Parse(*target)
+
+		if err != nil {
+			logger.Fatal("Failed to parse target because %s", err)
+		}
+
+		if u.Scheme != "s3" {
+			logger.Fatal("The -endpoint, -path-style, -disable-ssl and -part-size flags can only be used with s3:// targets")
+		}
+
+		q := u.Query()
+
+		for k, v := range extras {
+
+			if q.Get(k) == "" {
+				q.Set(k, v)
+			}
+		}
+
+		u.RawQuery = q.Encode()
+		*target = u.String()
+
+	} else if len(extras) > 0 {
+
+		dsn_map, err := dsn.StringToDSN(*str_dsn)
+
+		if err != nil {
+			logger.Fatal("Failed to parse DSN because %s", err)
+		}
+
+		for k, v := range extras {
+
+			_, ok := dsn_map[k]
+
+			if !ok {
+				dsn_map[k] = v
+			}
+		}
+
+		*str_dsn = dsn_map.String()
+	}
+
+	logger.Status("DSN is %s", *str_dsn)
+
+	var encryption *sync.EncryptionOptions
+
+	if *sse != "" || *sse_kms_key_id != "" || *sse_c_key_file != "" {
+
+		if *target != "" && !strings.HasPrefix(*target, "s3://") {
+			logger.Fatal("The -sse, -sse-kms-key-id and -sse-c-key-file flags can only be used with s3:// targets")
+		}
+
+		encryption = &sync.EncryptionOptions{
+			SSE:             *sse,
+			KMSKeyId:        *sse_kms_key_id,
+			CustomerKeyFile: *sse_c_key_file,
+		}
+	}
+
+	switch *direction {
+	case "push":
+		// pass
+	case "pull":
+
+		opts := sync.LocalSyncOptions{
+			DSN:        *str_dsn,
+			TargetURI:  *target,
+			Encryption: encryption,
+			RateLimit:  *ratelimit,
+			Dryrun:     *dryrun,
+			Force:      *force,
+			Verbose:    *verbose,
+			Logger:     logger,
+		}
+
+		pull(opts, *mode)
+		os.Exit(0)
+	default:
+		logger.Fatal("Invalid direction '%s'", *direction)
+	}
+
+	// only a whole repo is a complete picture of what exists locally; any
+	// other mode (a filelist, a single directory) would make everything
+	// else look like it had been deleted
+
+	if *prune && *mode != "repo" {
+		logger.Fatal("The -delete flag requires -mode repo")
+	}
+
+	// in -since mode the commits are compared up front so that a typo
+	// doesn't get as far as syncing anything
+
+	diffs := make([]*sync.GitDiff, 0)
+
+	if *since != "" {
+
+		if *mode != "repo" {
+			logger.Fatal("The -since flag requires -mode repo")
+		}
+
+		if *prune {
+			logger.Fatal("The -since and -delete flags can not be used together (records that were deleted between commits are always deleted remotely)")
+		}
+
+		for _, path := range flag.Args() {
+
+			d, err := sync.NewGitDiff(path, *since, *until)
+
+			if err != nil {
+				logger.Fatal("Failed to compare commits in %s because %s", path, err)
+			}
+
+			diffs = append(diffs, d)
+		}
+	}
+
+	var rules *sync.Rules
+
+	if *rules_file != "" {
+
+		r, err := sync.NewRulesFromFile(*rules_file)
+
+		if err != nil {
+			logger.Fatal("Failed to load rules because %s", err)
+		}
+
+		rules = r
+	}
+
+	var registry *metrics.Registry
+	var sync_metrics *sync.Metrics
+
+	if *metrics_addr != "" {
+
+		registry = metrics.NewRegistry()
+		sync_metrics = sync.NewMetrics(registry)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+
+		go func() {
+
+			err := http.ListenAndServe(*metrics_addr, mux)
+
+			if err != nil {
+				logger.Fatal("Failed to serve metrics because %s", err)
+			}
+		}()
+
+		logger.Status("Serving metrics at http://%s/metrics", *metrics_addr)
+	}
+
+	var requests_throttle throttle.Throttle
+
+	if *adaptive && *throttle_uri != "" {
+		logger.Fatal("The -adaptive-throttle and -throttle-uri flags can not be used together")
+	}
+
+	if *throttle_uri != "" {
+
+		per_sec := *requests_per_sec
+
+		if per_sec == 0 {
+			per_sec = 100
+		}
+
+		th, err := throttle.NewRedisThrottle(*throttle_uri, per_sec)
+
+		if err != nil {
+			logger.Fatal("Failed to create Redis throttle because %s", err)
+		}
+
+		requests_throttle = th
+	}
+
+	if *adaptive {
+
+		max_per_sec := *requests_per_sec
+
+		if max_per_sec == 0 {
+			max_per_sec = 100
+		}
+
+		th, err := throttle.NewAdaptiveThrottle(max_per_sec)
+
+		if err != nil {
+			logger.Fatal("Failed to create adaptive throttle because %s", err)
+		}
+
+		if registry != nil {
+			registry.NewGaugeFunc("wof_s3_sync_requests_per_second_limit", "The current (adaptive) requests per second limit.", th.Rate)
+		}
+
+		requests_throttle = th
 	}
 
-	logger.Status("DSN is %s", *dsn)
+	checkpoint_commit := ""
+
+	if *checkpoint != "" && len(diffs) > 0 {
+
+		commits := make([]string, 0)
+
+		for _, d := range diffs {
+			commits = append(commits, d.Since+".."+d.Until)
+		}
+
+		checkpoint_commit = strings.Join(commits, ",")
+
+	} else if *checkpoint != "" && *mode == "repo" {
+
+		commits := make([]string, 0)
+
+		for _, path := range flag.Args() {
+
+			commit, err := sync.GitCommit(path)
+
+			if err != nil {
+				logger.Warning("Failed to determine git commit for %s because %s, so the checkpoint will not be tied to a commit", path, err)
+				commits = nil
+				break
+			}
+
+			commits = append(commits, commit)
+		}
+
+		checkpoint_commit = strings.Join(commits, ",")
+	}
 
 	opts := sync.RemoteSyncOptions{
-		DSN:       *dsn,
-		ACL:       *acl,
-		RateLimit: *ratelimit,
-		Dryrun:    *dryrun,
-		Force:     *force,
-		Verbose:   *verbose,
-		Logger:    logger,
+		DSN:                *str_dsn,
+		TargetURI:          *target,
+		ACL:                *acl,
+		RateLimit:          *ratelimit,
+		MaxInFlight:        *max_in_flight,
+		RequestsPerSec:     *requests_per_sec,
+		BytesPerSec:        *bytes_per_sec,
+		Throttle:           requests_throttle,
+		MaxAttempts:        *max_attempts,
+		Backoff:            *backoff,
+		Prune:              *prune,
+		MaxDeletes:         *max_deletes,
+		Manifest:           *manifest,
+		ManifestKey:        *manifest_key,
+		RebuildManifest:    *rebuild_manifest,
+		Checkpoint:         *checkpoint,
+		CheckpointCommit:   checkpoint_commit,
+		CheckpointInterval: *checkpoint_interval,
+		Prefetch:           *prefetch,
+		Compress:           *compress,
+		Rules:              rules,
+		Encryption:         encryption,
+		Metrics:            sync_metrics,
+		Dryrun:             *dryrun,
+		Force:              *force,
+		Verbose:            *verbose,
+		Logger:             logger,
 	}
 
 	sync, err := sync.NewRemoteSync(opts)
@@ -61,7 +456,39 @@ func main() {
 		logger.Fatal("Failed to create new sync because %s", err)
 	}
 
-	sync_cb, err := sync.SyncFunc()
+	if *rebuild_manifest && len(flag.Args()) == 0 {
+
+		err := sync.SaveManifest()
+
+		if err != nil {
+			logger.Fatal("Failed to save manifest because %s", err)
+		}
+
+		os.Exit(0)
+	}
+
+	// the first SIGINT or SIGTERM stops anything new from being synced, but
+	// lets uploads that have already started finish, and the second one
+	// exits straight away
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signal_ch := make(chan os.Signal, 1)
+	signal.Notify(signal_ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+
+		sig := <-signal_ch
+		logger.Warning("Received %s, waiting for uploads in progress to finish (send it again to exit immediately)", sig)
+		cancel()
+
+		sig = <-signal_ch
+		logger.Warning("Received %s, exiting", sig)
+		os.Exit(1)
+	}()
+
+	sync_cb, err := sync.SyncFuncWithContext(ctx)
 
 	if err != nil {
 		logger.Fatal("Failed to create sync callback because %s", err)
@@ -73,6 +500,13 @@ func main() {
 		logger.Fatal("Failed to create indexer because %s", err)
 	}
 
+	if registry != nil {
+
+		registry.NewGaugeFunc("wof_s3_sync_indexed", "The number of files that have been indexed.", func() float64 {
+			return float64(atomic.LoadInt64(&idx.Indexed))
+		})
+	}
+
 	done_ch := make(chan bool)
 
 	go func() {
@@ -90,22 +524,175 @@ func main() {
 
 	t1 := time.Now()
 
-	for _, path := range flag.Args() {
+	indexed := true
+	timings := make([]*pathTiming, 0)
+
+	// once the sync has been interrupted the sync callback returns an error
+	// which stops the indexer walking any more files; the remaining paths
+	// are skipped altogether
+
+	for i, path := range flag.Args() {
+
+		if ctx.Err() != nil {
+			break
+		}
 
 		ta := time.Now()
+		count := atomic.LoadInt64(&idx.Indexed)
+
+		var err error
+
+		if len(diffs) > 0 {
+
+			d := diffs[i]
+			err = sync.SyncGitDiff(ctx, d)
+
+			// nothing is actually indexed but this keeps the counts
+			// and the -report file consistent with the other modes
+
+			atomic.AddInt64(&idx.Indexed, int64(len(d.Changed)+len(d.Deleted)))
+
+		} else {
+			err = idx.IndexPath(path)
+		}
+
+		tb := time.Since(ta)
+		count = atomic.LoadInt64(&idx.Indexed) - count
+
+		if err != nil && ctx.Err() != nil {
+			logger.Warning("Stopped indexing %s because the sync was interrupted", path)
+			timings = append(timings, &pathTiming{path, tb, count, nil})
+			break
+		}
+
+		// the indexer doesn't report errors walking directories (or
+		// opening the files in them) and simply stops so before deleting
+		// anything make sure every local file was actually indexed
+
+		if err == nil && *prune {
 
-		err := idx.IndexPath(path)
+			data := filepath.Join(path, "data")
+			expected, walk_err := count_files(data)
+
+			if walk_err != nil {
+				err = fmt.Errorf("Failed to count the files in %s because %s", data, walk_err)
+			} else if count < expected {
+				err = fmt.Errorf("Only %d of the %d files in %s were indexed", count, expected, data)
+			}
+		}
+
+		timings = append(timings, &pathTiming{path, tb, count, err})
 
 		if err != nil {
 			logger.Warning("Failed to index %s because %s", path, err)
+			indexed = false
 			break
 		}
 
-		tb := time.Since(ta)
 		logger.Status("time to index %s : %v\n", path, tb)
 	}
 
-	// please handle retries here
+	// errors that aren't specific to a single file, for the -report file
+
+	errors := make([]error, 0)
+
+	err = sync.RetryWithContext(ctx)
+
+	if err != nil {
+		logger.Warning("Failed to retry failed files because %s", err)
+		errors = append(errors, fmt.Errorf("Failed to retry failed files because %s", err))
+	}
+
+	failures := sync.Failures()
+
+	if len(failures) > 0 {
+
+		logger.Warning("Failed to sync %d files", len(failures))
+
+		if *failures_file != "" {
+
+			err := sync.WriteFailures(*failures_file)
+
+			if err != nil {
+				logger.Warning("Failed to write %s because %s", *failures_file, err)
+			}
+		}
+	}
+
+	interrupted := ctx.Err() != nil
+
+	if interrupted {
+
+		errors = append(errors, fmt.Errorf("Sync was interrupted"))
+
+		path := *resume_file
+
+		if path == "" {
+
+			fh, err := ioutil.TempFile("", "wof-s3-sync-resume")
+
+			if err == nil {
+				path = fh.Name()
+				fh.Close()
+			} else {
+				logger.Warning("Failed to create resume file because %s", err)
+			}
+		}
+
+		if path != "" {
+
+			err := sync.WriteUnsynced(path)
+
+			if err != nil {
+				logger.Warning("Failed to write %s because %s", path, err)
+			} else {
+				logger.Warning("Sync was interrupted, wrote the paths of files that were in progress, failed or waiting to be retried to %s", path)
+			}
+		}
+
+		switch {
+		case *checkpoint != "":
+			logger.Warning("Resume the sync by running it again with -checkpoint %s, which skips the files that have already been synced", *checkpoint)
+		case *manifest != "" || *manifest_key != "":
+			logger.Warning("Resume the sync by running it again with the same manifest, which avoids checking files that have already been synced")
+		default:
+			logger.Warning("Resume the sync by running it again; use -checkpoint to avoid checking files that have already been synced next time")
+		}
+	}
+
+	if *prune {
+
+		if indexed && !interrupted {
+
+			err := sync.Prune()
+
+			if err != nil {
+				logger.Warning("Failed to delete remote files because %s", err)
+				errors = append(errors, fmt.Errorf("Failed to delete remote files because %s", err))
+			}
+
+		} else {
+			logger.Warning("Indexing did not complete successfully so not deleting remote files")
+		}
+	}
+
+	err = sync.SaveManifest()
+
+	if err != nil {
+		logger.Warning("Failed to save manifest because %s", err)
+		errors = append(errors, fmt.Errorf("Failed to save manifest because %s", err))
+	}
+
+	// there's nothing to resume once everything has been synced
+
+	completed := indexed && !interrupted && len(failures) == 0 && len(errors) == 0
+
+	err = sync.CloseCheckpoint(completed)
+
+	if err != nil {
+		logger.Warning("Failed to save checkpoint because %s", err)
+		errors = append(errors, fmt.Errorf("Failed to save checkpoint because %s", err))
+	}
 
 	done_ch <- true
 
@@ -113,4 +700,29 @@ func main() {
 	i := atomic.LoadInt64(&idx.Indexed) // see above
 
 	logger.Status("time to index %d documents : %v\n", i, t2)
+
+	if *report_file != "" {
+
+		report := sync.Report()
+
+		for _, p := range timings {
+			report.AddPath(p.path, p.duration, p.indexed, p.err)
+		}
+
+		for _, err := range errors {
+			report.AddError(err)
+		}
+
+		report.Finish()
+
+		err := report.WriteFile(*report_file)
+
+		if err != nil {
+			logger.Warning("Failed to write %s because %s", *report_file, err)
+		}
+	}
+
+	if interrupted {
+		os.Exit(1)
+	}
 }
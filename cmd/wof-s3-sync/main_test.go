@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"github.com/whosonfirst/go-whosonfirst-s3/sync"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBucket = "data.whosonfirst.org"
+
+// Tests run the tool by re-executing the test binary with WOF_S3_SYNC_MAIN
+// set, which causes TestMain to call main() with the arguments passed to it.
+
+func TestMain(m *testing.M) {
+
+	if os.Getenv("WOF_S3_SYNC_MAIN") != "" {
+		os.Args = append([]string{"wof-s3-sync"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func run(t *testing.T, args ...string) string {
+
+	cmd := exec.Command(os.Args[0], args...)
+
+	cmd.Env = append(os.Environ(),
+		"WOF_S3_SYNC_MAIN=1",
+		"AWS_ACCESS_KEY_ID=fakes3",
+		"AWS_SECRET_ACCESS_KEY=fakes3",
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Failed to run wof-s3-sync %v, %s\n%s", args, err, out)
+	}
+
+	return string(out)
+}
+
+// runError is like run but expects wof-s3-sync to fail.
+
+func runError(t *testing.T, args ...string) string {
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "WOF_S3_SYNC_MAIN=1")
+
+	out, err := cmd.CombinedOutput()
+
+	if err == nil {
+		t.Fatalf("Expected wof-s3-sync %v to fail\n%s", args, out)
+	}
+
+	return string(out)
+}
+
+func testRepo(t *testing.T) (string, map[string][]byte) {
+
+	root, err := ioutil.TempDir("", "whosonfirst-data")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+
+	for _, id := range []int64{101736545, 85632793, 1} {
+
+		rel_path, err := uri.Id2RelPath(id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := []byte(fmt.Sprintf(`{"type":"Feature","properties":{"wof:id":%d}}`, id))
+		files[rel_path] = body
+
+		path := filepath.Join(root, "data", rel_path)
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(path, body, 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, files
+}
+
+func TestPush(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	run(t, "-dsn", srv.DSN(testBucket, "data"), "-mode", "repo", root)
+
+	for rel_path, body := range files {
+
+		obj := srv.Object(testBucket, filepath.Join("data", rel_path))
+
+		if obj == nil {
+			t.Fatalf("Missing remote object for %s", rel_path)
+		}
+
+		if !bytes.Equal(obj.Body, body) {
+			t.Fatalf("Unexpected body for %s", rel_path)
+		}
+
+		if obj.ACL != "public-read" {
+			t.Fatalf("Unexpected ACL for %s: '%s'", rel_path, obj.ACL)
+		}
+	}
+}
+
+func TestPushEndpoint(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	run(t, "-bucket", testBucket, "-prefix", "data", "-credentials", "env:", "-endpoint", srv.URL, "-path-style", "-mode", "repo", root)
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %v", len(files), srv.Keys(testBucket))
+	}
+}
+
+func TestPushEndpointTarget(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	target := fmt.Sprintf("s3://%s/data?credentials=env:", testBucket)
+
+	run(t, "-target", target, "-endpoint", srv.URL, "-path-style", "-mode", "repo", root)
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %v", len(files), srv.Keys(testBucket))
+	}
+
+	out := runError(t, "-target", "mem://", "-endpoint", srv.URL, "-mode", "repo", root)
+
+	if !strings.Contains(out, "can only be used with s3:// targets") {
+		t.Fatalf("Unexpected output: %s", out)
+	}
+
+	for _, args := range [][]string{{"-sse", "AES256"}, {"-sse", "aws:kms", "-sse-kms-key-id", "alias/whosonfirst"}, {"-sse-c-key-file", "/dev/null"}} {
+
+		args = append(args, "-target", "mem://", "-mode", "repo", root)
+		out := runError(t, args...)
+
+		if !strings.Contains(out, "can only be used with s3:// targets") {
+			t.Fatalf("Unexpected output for %v: %s", args, out)
+		}
+	}
+}
+
+func TestPushDryrun(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, _ := testRepo(t)
+	defer os.RemoveAll(root)
+
+	run(t, "-dsn", srv.DSN(testBucket, "data"), "-mode", "repo", "-dryrun", root)
+
+	if len(srv.Keys(testBucket)) != 0 {
+		t.Fatalf("Expected no keys but got %v", srv.Keys(testBucket))
+	}
+}
+
+func TestPushDelete(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	orphan := "data/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, orphan, []byte(`{}`))
+
+	run(t, "-dsn", srv.DSN(testBucket, "data"), "-mode", "repo", "-delete", root)
+
+	if srv.Object(testBucket, orphan) != nil {
+		t.Fatal("Orphan was not deleted")
+	}
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %v", len(files), srv.Keys(testBucket))
+	}
+}
+
+func TestPushDeleteWalkError(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	for id := int64(1100); id < 1300; id++ {
+
+		rel_path, err := uri.Id2RelPath(id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := []byte(fmt.Sprintf(`{"type":"Feature","properties":{"wof:id":%d}}`, id))
+		files[rel_path] = body
+
+		path := filepath.Join(root, "data", rel_path)
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(path, body, 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dsn := srv.DSN(testBucket, "data")
+
+	run(t, "-dsn", dsn, "-mode", "repo", root)
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %d", len(files), len(srv.Keys(testBucket)))
+	}
+
+	// the indexer stops walking, without reporting an error, when it can't
+	// open a file so none of the files after this one are indexed
+
+	err := os.Symlink("/nonexistent", filepath.Join(root, "data", "110", "0", "1100-alt-x.geojson"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := "data/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, orphan, []byte(`{}`))
+
+	out := run(t, "-dsn", dsn, "-mode", "repo", "-delete", "-verbose", root)
+
+	if !strings.Contains(out, "not deleting remote files") {
+		t.Fatalf("Expected remote files not to be deleted\n%s", out)
+	}
+
+	if len(srv.Keys(testBucket)) != len(files)+1 {
+		t.Fatalf("Expected %d keys but got %d", len(files)+1, len(srv.Keys(testBucket)))
+	}
+}
+
+func TestPull(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	_, files := testRepo(t)
+
+	for rel_path, body := range files {
+		srv.PutObject(testBucket, filepath.Join("data", rel_path), body)
+	}
+
+	root, err := ioutil.TempDir("", "pull")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	run(t, "-dsn", srv.DSN(testBucket, "data"), "-direction", "pull", "-mode", "repo", root)
+
+	for rel_path, body := range files {
+
+		local, err := ioutil.ReadFile(filepath.Join(root, "data", rel_path))
+
+		if err != nil {
+			t.Fatalf("Failed to read %s, %s", rel_path, err)
+		}
+
+		if !bytes.Equal(local, body) {
+			t.Fatalf("Unexpected body for %s", rel_path)
+		}
+	}
+}
+
+func TestPushReport(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	err := ioutil.WriteFile(filepath.Join(root, "data", "README.md"), []byte("not a WOF record"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report_path := filepath.Join(root, "report.json")
+
+	read_report := func() *sync.Report {
+
+		body, err := ioutil.ReadFile(report_path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r sync.Report
+
+		err = json.Unmarshal(body, &r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &r
+	}
+
+	run(t, "-dsn", srv.DSN(testBucket, "data"), "-mode", "repo", "-report", report_path, root)
+
+	r := read_report()
+
+	if !r.OK {
+		t.Fatalf("Expected report to be OK: %v", r.Errors)
+	}
+
+	count := int64(len(files))
+
+	if r.Counts.Checked != count || r.Counts.Uploaded != count || r.Counts.Unchanged != 0 || r.Counts.Skipped != 1 || r.Counts.Failed != 0 {
+		t.Fatalf("Unexpected counts: %+v", r.Counts)
+	}
+
+	if r.Counts.Bytes == 0 {
+		t.Fatal("Expected some bytes to have been uploaded")
+	}
+
+	if len(r.Paths) != 1 || r.Paths[0].Path != root || r.Paths[0].Indexed == 0 {
+		t.Fatalf("Unexpected paths: %+v", r.Paths)
+	}
+
+	if r.Options.ACL != "public-read" || r.Options.MaxAttempts != 5 {
+		t.Fatalf("Unexpected options: %+v", r.Options)
+	}
+
+	// nothing has changed the second time around
+
+	run(t, "-dsn", srv.DSN(testBucket, "data"), "-mode", "repo", "-report", report_path, root)
+
+	r = read_report()
+
+	if r.Counts.Checked != count || r.Counts.Unchanged != count || r.Counts.Uploaded != 0 || r.Counts.Bytes != 0 {
+		t.Fatalf("Unexpected counts: %+v", r.Counts)
+	}
+}
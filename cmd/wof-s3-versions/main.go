@@ -0,0 +1,145 @@
+package main
+
+/*
+
+Given one or more IDs this prints the version history of every key in
+their directories, one version per line, newest first:
+
+	KEY	VERSION_ID	LAST_MODIFIED	SIZE	ETAG	FLAGS
+
+FLAGS is "latest" for the current version of a key and "deleted" for
+delete markers. Objects in buckets that have never been versioned have
+a single version whose ID is "null". For example:
+
+$> ./bin/wof-s3-versions -s3-dsn 'bucket=data.whosonfirst.org region=us-east-1 prefix=data credentials=session' 1159324849
+
+*/
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func print_versions(conn *s3.S3Connection, id int64, wr io.Writer) error {
+
+	path, err := uri.Id2Path(id)
+
+	if err != nil {
+		return err
+	}
+
+	cb := func(v *s3.S3ObjectVersion) error {
+
+		flags := make([]string, 0)
+
+		if v.IsLatest {
+			flags = append(flags, "latest")
+		}
+
+		if v.DeleteMarker {
+			flags = append(flags, "deleted")
+		}
+
+		size := "-"
+		etag := "-"
+
+		if !v.DeleteMarker {
+			size = strconv.FormatInt(v.Size, 10)
+			etag = v.ETag
+		}
+
+		str_flags := strings.Join(flags, ",")
+
+		if str_flags == "" {
+			str_flags = "-"
+		}
+
+		_, err := fmt.Fprintf(wr, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Key, v.VersionId, v.LastModified.UTC().Format(time.RFC3339), size, etag, str_flags)
+		return err
+	}
+
+	opts := s3.DefaultS3ListOptions()
+	opts.Path = path + "/"
+
+	return conn.ListVersions(cb, opts)
+}
+
+func main() {
+
+	stdin := flag.Bool("stdin", false, "Read IDs from STDIN.")
+	s3_dsn := flag.String("s3-dsn", "", "A valid go-whosonfirst-aws DSN string for talking to S3.")
+
+	flag.Parse()
+
+	ids := make([]int64, 0)
+
+	add := func(str_id string) {
+
+		id, err := strconv.ParseInt(strings.TrimSpace(str_id), 10, 64)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if *stdin {
+
+		scanner := bufio.NewScanner(os.Stdin)
+
+		for scanner.Scan() {
+			add(scanner.Text())
+		}
+
+	} else {
+
+		for _, str_id := range flag.Args() {
+			add(str_id)
+		}
+	}
+
+	if len(ids) == 0 {
+		log.Fatal("Missing IDs")
+	}
+
+	cfg, err := s3.NewS3ConfigFromString(*s3_dsn)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := s3.NewS3Connection(cfg)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wr := bufio.NewWriter(os.Stdout)
+
+	for _, id := range ids {
+
+		err := print_versions(conn, id, wr)
+
+		if err != nil {
+			log.Fatalf("Failed to list versions for %d because %s", id, err)
+		}
+	}
+
+	err = wr.Flush()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const testBucket = "data.whosonfirst.org"
+
+// As with wof-s3-delete tests run the tool by re-executing the test binary
+// with WOF_S3_VERSIONS_MAIN set.
+
+func TestMain(m *testing.M) {
+
+	if os.Getenv("WOF_S3_VERSIONS_MAIN") != "" {
+		os.Args = append([]string{"wof-s3-versions"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestVersions(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	srv.EnableVersioning(testBucket)
+
+	primary := "data/115/932/484/9/1159324849.geojson"
+
+	srv.PutObject(testBucket, primary, []byte(`{"v":1}`))
+	srv.PutObject(testBucket, primary, []byte(`{"v":2}`))
+	srv.PutObject(testBucket, "data/115/932/484/9/1159324849.jpg", []byte(`jpg`))
+	srv.PutObject(testBucket, "data/101/736/545/101736545.geojson", []byte(`{}`))
+
+	cmd := exec.Command(os.Args[0], "-s3-dsn", srv.DSN(testBucket, "data"), "1159324849")
+
+	cmd.Env = append(os.Environ(),
+		"WOF_S3_VERSIONS_MAIN=1",
+		"AWS_ACCESS_KEY_ID=fakes3",
+		"AWS_SECRET_ACCESS_KEY=fakes3",
+	)
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		t.Fatalf("Failed to run wof-s3-versions, %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 versions but got:\n%s", out)
+	}
+
+	versions := srv.Versions(testBucket, primary)
+
+	latest := strings.Split(lines[0], "\t")
+	previous := strings.Split(lines[1], "\t")
+
+	if latest[0] != "115/932/484/9/1159324849.geojson" || latest[1] != versions[1].VersionId || latest[3] != "7" || latest[5] != "latest" {
+		t.Fatalf("Unexpected latest version: %s", lines[0])
+	}
+
+	if previous[1] != versions[0].VersionId || previous[5] != "-" {
+		t.Fatalf("Unexpected previous version: %s", lines[1])
+	}
+
+	if !strings.HasPrefix(lines[2], "115/932/484/9/1159324849.jpg\t") {
+		t.Fatalf("Unexpected version: %s", lines[2])
+	}
+}
@@ -0,0 +1,1323 @@
+package fakes3
+
+// This is an in-process, S3-compatible HTTP server for testing things that
+// talk to S3 without talking to AWS. It supports path-style requests for
+// PUT, GET, HEAD and DELETE object requests, CopyObject requests, multipart
+// uploads, DeleteObjects, ListObjects (v1 and v2) and ListObjectVersions
+// requests. Buckets can be versioned, in which case DELETE requests (without a
+// version ID) add a delete marker rather than removing anything. It does not
+// check signatures or credentials and keeps everything in memory. Point an
+// S3Connection at it with a DSN string like:
+//
+//	bucket={BUCKET} region=us-east-1 credentials=env: endpoint={SERVER.URL} path-style=true
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Object struct {
+	Key                string
+	Body               []byte
+	ETag               string // including the surrounding quotes, as S3 does
+	ACL                string
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	StorageClass       string
+	Tagging            string // the (URL encoded) x-amz-tagging header
+	SSE                string // "AES256", "aws:kms" or empty
+	SSEKMSKeyId        string
+	SSECustomer        bool              // true if the object was encrypted with SSE-C
+	Metadata           map[string]string // x-amz-meta-* headers, without the prefix
+	LastModified       time.Time
+	VersionId          string // "null" unless the object was stored in a versioned bucket
+	DeleteMarker       bool   // true if this is a delete marker rather than an object
+}
+
+type upload struct {
+	bucket string
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+type failure struct {
+	method string
+	code   string
+	status int
+	count  int
+}
+
+type Server struct {
+	*httptest.Server
+	buckets        map[string]map[string]*Object
+	versions       map[string]map[string][]*Object // the version histories of every key in versioned buckets, oldest first
+	version        int
+	uploads        map[string]*upload
+	failures       []*failure
+	deleteFailures map[string]string // keys that DeleteObjects fails to delete, and the error code
+	requests       map[string]int
+	mu             *sync.Mutex
+}
+
+func NewServer(buckets ...string) *Server {
+
+	s := &Server{
+		buckets:        make(map[string]map[string]*Object),
+		versions:       make(map[string]map[string][]*Object),
+		uploads:        make(map[string]*upload),
+		failures:       make([]*failure, 0),
+		deleteFailures: make(map[string]string),
+		requests:       make(map[string]int),
+		mu:             new(sync.Mutex),
+	}
+
+	for _, b := range buckets {
+		s.CreateBucket(b)
+	}
+
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// DSN returns a go-whosonfirst-s3 DSN string for talking to bucket on this server.
+
+func (s *Server) DSN(bucket string, prefix string) string {
+
+	dsn := fmt.Sprintf("bucket=%s region=us-east-1 credentials=env: endpoint=%s path-style=true", bucket, s.URL)
+
+	if prefix != "" {
+		dsn = fmt.Sprintf("%s prefix=%s", dsn, prefix)
+	}
+
+	return dsn
+}
+
+func (s *Server) CreateBucket(bucket string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.buckets[bucket]
+
+	if !ok {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+}
+
+// EnableVersioning turns on versioning for bucket. Any objects that are
+// already in the bucket become versions with the ID "null", as in S3.
+
+func (s *Server) EnableVersioning(bucket string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.versions[bucket]
+
+	if ok {
+		return
+	}
+
+	history := make(map[string][]*Object)
+
+	for k, obj := range s.buckets[bucket] {
+		history[k] = []*Object{obj}
+	}
+
+	s.versions[bucket] = history
+}
+
+// Versions returns copies of every version (including delete markers) of key
+// in bucket, oldest first, or nil if the bucket is not versioned.
+
+func (s *Server) Versions(bucket string, key string) []*Object {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, ok := s.versions[bucket]
+
+	if !ok {
+		return nil
+	}
+
+	versions := make([]*Object, 0)
+
+	for _, obj := range history[key] {
+		copy_obj := *obj
+		versions = append(versions, &copy_obj)
+	}
+
+	return versions
+}
+
+// Object returns a copy of the object for key in bucket, or nil if it doesn't exist.
+
+func (s *Server) Object(bucket string, key string) *Object {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+
+	if !ok {
+		return nil
+	}
+
+	obj, ok := objects[key]
+
+	if !ok {
+		return nil
+	}
+
+	copy_obj := *obj
+	return &copy_obj
+}
+
+// Keys returns the sorted list of keys in bucket.
+
+func (s *Server) Keys(bucket string) []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0)
+
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// PutObject stores body in bucket as key, bypassing HTTP altogether.
+
+func (s *Server) PutObject(bucket string, key string, body []byte) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+
+	if !ok {
+		objects = make(map[string]*Object)
+		s.buckets[bucket] = objects
+	}
+
+	s.store(bucket, key, newObject(key, body))
+}
+
+// Fail causes the next count requests with method to fail with the
+// S3 error code and HTTP status.
+
+func (s *Server) Fail(method string, code string, status int, count int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := &failure{
+		method: method,
+		code:   code,
+		status: status,
+		count:  count,
+	}
+
+	s.failures = append(s.failures, f)
+}
+
+// FailDelete causes DeleteObjects requests to report that key, in bucket,
+// could not be deleted with the S3 error code. DELETE requests for a single
+// object are not affected.
+
+func (s *Server) FailDelete(bucket string, key string, code string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteFailures[bucket+"/"+key] = code
+}
+
+// Requests returns the number of requests with method that the server has handled.
+
+func (s *Server) Requests(method string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method]
+}
+
+func (s *Server) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+
+	s.mu.Lock()
+	s.requests[req.Method] += 1
+	s.mu.Unlock()
+
+	if s.injectFailure(rsp, req) {
+		return
+	}
+
+	path := strings.TrimLeft(req.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+
+	bucket := parts[0]
+	key := ""
+
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	if bucket == "" {
+		writeError(rsp, req, "InvalidRequest", "Missing bucket", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	_, ok := s.buckets[bucket]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(rsp, req, "NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound)
+		return
+	}
+
+	if key == "" {
+
+		_, is_delete := req.URL.Query()["delete"]
+		_, is_versions := req.URL.Query()["versions"]
+
+		switch {
+		case req.Method == "GET" && is_versions:
+			s.listObjectVersions(rsp, req, bucket)
+		case req.Method == "GET":
+			s.listObjects(rsp, req, bucket)
+		case req.Method == "POST" && is_delete:
+			s.deleteObjects(rsp, req, bucket)
+		default:
+			writeError(rsp, req, "NotImplemented", "Not implemented", http.StatusNotImplemented)
+		}
+
+		return
+	}
+
+	q := req.URL.Query()
+
+	_, is_uploads := q["uploads"]
+	upload_id := q.Get("uploadId")
+
+	switch {
+	case req.Method == "POST" && is_uploads:
+		s.createMultipartUpload(rsp, req, bucket, key)
+	case req.Method == "PUT" && upload_id != "":
+		s.uploadPart(rsp, req, upload_id)
+	case req.Method == "POST" && upload_id != "":
+		s.completeMultipartUpload(rsp, req, upload_id)
+	case req.Method == "DELETE" && upload_id != "":
+		s.abortMultipartUpload(rsp, req, upload_id)
+	case req.Method == "PUT" && req.Header.Get("x-amz-copy-source") != "":
+		s.copyObject(rsp, req, bucket, key)
+	case req.Method == "PUT":
+		s.putObject(rsp, req, bucket, key)
+	case req.Method == "GET" || req.Method == "HEAD":
+		s.getObject(rsp, req, bucket, key)
+	case req.Method == "DELETE":
+		s.deleteObject(rsp, req, bucket, key)
+	default:
+		writeError(rsp, req, "NotImplemented", "Not implemented", http.StatusNotImplemented)
+	}
+}
+
+func (s *Server) injectFailure(rsp http.ResponseWriter, req *http.Request) bool {
+
+	s.mu.Lock()
+
+	var f *failure
+
+	for _, candidate := range s.failures {
+
+		if candidate.method == req.Method && candidate.count > 0 {
+			candidate.count -= 1
+			f = candidate
+			break
+		}
+	}
+
+	s.mu.Unlock()
+
+	if f == nil {
+		return false
+	}
+
+	writeError(rsp, req, f.code, "Injected failure", f.status)
+	return true
+}
+
+func (s *Server) putObject(rsp http.ResponseWriter, req *http.Request, bucket string, key string) {
+
+	body, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		writeError(rsp, req, "IncompleteBody", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	obj := newObject(key, body)
+	applyHeaders(obj, req.Header)
+
+	s.mu.Lock()
+	s.store(bucket, key, obj)
+	s.mu.Unlock()
+
+	setVersionHeader(rsp, obj)
+
+	rsp.Header().Set("ETag", obj.ETag)
+	rsp.WriteHeader(http.StatusOK)
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// copyObject copies the object named by the x-amz-copy-source header, which
+// looks like {BUCKET}/{KEY}, to key in bucket. Like S3 its metadata is copied
+// but its ACL (and encryption) come from the request.
+
+func (s *Server) copyObject(rsp http.ResponseWriter, req *http.Request, bucket string, key string) {
+
+	source, err := url.PathUnescape(strings.TrimLeft(req.Header.Get("x-amz-copy-source"), "/"))
+
+	if err != nil {
+		writeError(rsp, req, "InvalidArgument", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.SplitN(source, "/", 2)
+
+	if len(parts) != 2 {
+		writeError(rsp, req, "InvalidArgument", "Invalid copy source", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, ok := s.buckets[parts[0]][parts[1]]
+
+	if !ok {
+		writeError(rsp, req, "NoSuchKey", "The specified key does not exist.", http.StatusNotFound)
+		return
+	}
+
+	obj := newObject(key, src.Body)
+
+	obj.ContentType = src.ContentType
+	obj.ContentEncoding = src.ContentEncoding
+	obj.CacheControl = src.CacheControl
+	obj.ContentDisposition = src.ContentDisposition
+	obj.StorageClass = src.StorageClass
+	obj.Tagging = src.Tagging
+
+	for k, v := range src.Metadata {
+		obj.Metadata[k] = v
+	}
+
+	obj.ACL = req.Header.Get("x-amz-acl")
+	obj.SSE = req.Header.Get("x-amz-server-side-encryption")
+	obj.SSEKMSKeyId = req.Header.Get("x-amz-server-side-encryption-aws-kms-key-id")
+	obj.SSECustomer = req.Header.Get("x-amz-server-side-encryption-customer-algorithm") != ""
+
+	if obj.SSE == "aws:kms" || obj.SSECustomer {
+		enc := md5.Sum(append([]byte(obj.ETag), obj.Body...))
+		obj.ETag = fmt.Sprintf("\"%s\"", hex.EncodeToString(enc[:]))
+	}
+
+	s.store(bucket, key, obj)
+	setVersionHeader(rsp, obj)
+
+	result := copyObjectResult{
+		ETag:         obj.ETag,
+		LastModified: obj.LastModified.UTC().Format(time.RFC3339),
+	}
+
+	writeXML(rsp, http.StatusOK, result)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (s *Server) createMultipartUpload(rsp http.ResponseWriter, req *http.Request, bucket string, key string) {
+
+	s.mu.Lock()
+
+	upload_id := fmt.Sprintf("upload-%d", len(s.uploads)+1)
+
+	s.uploads[upload_id] = &upload{
+		bucket: bucket,
+		key:    key,
+		header: req.Header,
+		parts:  make(map[int][]byte),
+	}
+
+	s.mu.Unlock()
+
+	result := initiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: upload_id,
+	}
+
+	writeXML(rsp, http.StatusOK, result)
+}
+
+func (s *Server) uploadPart(rsp http.ResponseWriter, req *http.Request, upload_id string) {
+
+	part_number, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+
+	if err != nil || part_number < 1 {
+		writeError(rsp, req, "InvalidArgument", "Invalid partNumber", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		writeError(rsp, req, "IncompleteBody", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+
+	u, ok := s.uploads[upload_id]
+
+	if ok {
+		u.parts[part_number] = body
+	}
+
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(rsp, req, "NoSuchUpload", "The specified upload does not exist.", http.StatusNotFound)
+		return
+	}
+
+	enc := md5.Sum(body)
+
+	rsp.Header().Set("ETag", fmt.Sprintf("\"%s\"", hex.EncodeToString(enc[:])))
+	rsp.WriteHeader(http.StatusOK)
+}
+
+// completeMultipartUpload assembles the parts listed in the request, in order,
+// and assigns the resulting object an ETag the way that S3 does: the MD5 hash
+// of the (binary) MD5 hashes of each part followed by "-" and the number of parts.
+
+func (s *Server) completeMultipartUpload(rsp http.ResponseWriter, req *http.Request, upload_id string) {
+
+	var complete completeMultipartUpload
+
+	err := xml.NewDecoder(req.Body).Decode(&complete)
+
+	if err != nil {
+		writeError(rsp, req, "MalformedXML", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[upload_id]
+
+	if !ok {
+		writeError(rsp, req, "NoSuchUpload", "The specified upload does not exist.", http.StatusNotFound)
+		return
+	}
+
+	body := make([]byte, 0)
+	hashes := make([]byte, 0)
+
+	for _, p := range complete.Parts {
+
+		part, ok := u.parts[p.PartNumber]
+
+		if !ok {
+			writeError(rsp, req, "InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest)
+			return
+		}
+
+		enc := md5.Sum(part)
+
+		body = append(body, part...)
+		hashes = append(hashes, enc[:]...)
+	}
+
+	enc := md5.Sum(hashes)
+
+	obj := newObject(u.key, body)
+	obj.ETag = fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(enc[:]), len(complete.Parts))
+
+	applyHeaders(obj, u.header)
+
+	s.store(u.bucket, u.key, obj)
+	delete(s.uploads, upload_id)
+
+	setVersionHeader(rsp, obj)
+
+	result := completeMultipartUploadResult{
+		Location: fmt.Sprintf("%s/%s/%s", s.URL, u.bucket, u.key),
+		Bucket:   u.bucket,
+		Key:      u.key,
+		ETag:     obj.ETag,
+	}
+
+	writeXML(rsp, http.StatusOK, result)
+}
+
+func (s *Server) abortMultipartUpload(rsp http.ResponseWriter, req *http.Request, upload_id string) {
+
+	s.mu.Lock()
+	delete(s.uploads, upload_id)
+	s.mu.Unlock()
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getObject(rsp http.ResponseWriter, req *http.Request, bucket string, key string) {
+
+	s.mu.Lock()
+	obj, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(rsp, req, "NoSuchKey", "The specified key does not exist.", http.StatusNotFound)
+		return
+	}
+
+	h := rsp.Header()
+	h.Set("ETag", obj.ETag)
+	h.Set("Content-Length", strconv.Itoa(len(obj.Body)))
+	h.Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+
+	if obj.ContentType != "" {
+		h.Set("Content-Type", obj.ContentType)
+	}
+
+	if obj.ContentEncoding != "" {
+		h.Set("Content-Encoding", obj.ContentEncoding)
+	}
+
+	if obj.CacheControl != "" {
+		h.Set("Cache-Control", obj.CacheControl)
+	}
+
+	if obj.ContentDisposition != "" {
+		h.Set("Content-Disposition", obj.ContentDisposition)
+	}
+
+	if obj.StorageClass != "" {
+		h.Set("x-amz-storage-class", obj.StorageClass)
+	}
+
+	if obj.SSE != "" {
+		h.Set("x-amz-server-side-encryption", obj.SSE)
+	}
+
+	if obj.SSEKMSKeyId != "" {
+		h.Set("x-amz-server-side-encryption-aws-kms-key-id", obj.SSEKMSKeyId)
+	}
+
+	if obj.SSECustomer {
+		h.Set("x-amz-server-side-encryption-customer-algorithm", "AES256")
+	}
+
+	for k, v := range obj.Metadata {
+		h.Set("x-amz-meta-"+k, v)
+	}
+
+	rsp.WriteHeader(http.StatusOK)
+
+	if req.Method == "GET" {
+		rsp.Write(obj.Body)
+	}
+}
+
+// deleteObject deletes key from bucket or, if there is a versionId query
+// parameter, permanently deletes that version of it. Deleting a key in a
+// versioned bucket adds a delete marker instead.
+
+func (s *Server) deleteObject(rsp http.ResponseWriter, req *http.Request, bucket string, key string) {
+
+	version_id := req.URL.Query().Get("versionId")
+
+	s.mu.Lock()
+
+	var obj *Object
+
+	if version_id != "" {
+		obj = s.removeVersion(bucket, key, version_id)
+	} else {
+		obj = s.remove(bucket, key)
+	}
+
+	s.mu.Unlock()
+
+	if obj != nil {
+
+		h := rsp.Header()
+		h.Set("x-amz-version-id", obj.VersionId)
+
+		if obj.DeleteMarker {
+			h.Set("x-amz-delete-marker", "true")
+		}
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
+
+// store makes obj the current version of key in bucket, adding it to the
+// key's version history if the bucket is versioned. The caller must hold s.mu.
+
+func (s *Server) store(bucket string, key string, obj *Object) {
+
+	history, versioned := s.versions[bucket]
+
+	if versioned {
+		obj.VersionId = s.nextVersionId()
+		history[key] = append(history[key], obj)
+	}
+
+	s.buckets[bucket][key] = obj
+}
+
+// remove deletes key from bucket, returning the delete marker that replaces
+// it if the bucket is versioned. The caller must hold s.mu.
+
+func (s *Server) remove(bucket string, key string) *Object {
+
+	delete(s.buckets[bucket], key)
+
+	history, versioned := s.versions[bucket]
+
+	if !versioned {
+		return nil
+	}
+
+	marker := Object{
+		Key:          key,
+		DeleteMarker: true,
+		LastModified: time.Now(),
+		VersionId:    s.nextVersionId(),
+	}
+
+	history[key] = append(history[key], &marker)
+	return &marker
+}
+
+// removeVersion permanently deletes version_id of key from bucket, returning
+// it (or nil if there is no such version). If it was the latest version then
+// the one before it, unless that is a delete marker, becomes the current
+// object. The caller must hold s.mu.
+
+func (s *Server) removeVersion(bucket string, key string, version_id string) *Object {
+
+	history, versioned := s.versions[bucket]
+
+	if !versioned {
+
+		obj, ok := s.buckets[bucket][key]
+
+		if !ok || version_id != obj.VersionId {
+			return nil
+		}
+
+		delete(s.buckets[bucket], key)
+		return obj
+	}
+
+	versions := history[key]
+
+	for i, obj := range versions {
+
+		if obj.VersionId != version_id {
+			continue
+		}
+
+		versions = append(versions[:i:i], versions[i+1:]...)
+
+		if len(versions) == 0 {
+			delete(history, key)
+			delete(s.buckets[bucket], key)
+			return obj
+		}
+
+		history[key] = versions
+		latest := versions[len(versions)-1]
+
+		if latest.DeleteMarker {
+			delete(s.buckets[bucket], key)
+		} else {
+			s.buckets[bucket][key] = latest
+		}
+
+		return obj
+	}
+
+	return nil
+}
+
+func (s *Server) nextVersionId() string {
+	s.version += 1
+	return fmt.Sprintf("%020d", s.version)
+}
+
+func setVersionHeader(rsp http.ResponseWriter, obj *Object) {
+
+	if obj.VersionId != "null" {
+		rsp.Header().Set("x-amz-version-id", obj.VersionId)
+	}
+}
+
+type deleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Objects []struct {
+		Key       string `xml:"Key"`
+		VersionId string `xml:"VersionId"`
+	} `xml:"Object"`
+	Quiet bool `xml:"Quiet"`
+}
+
+type deletedObject struct {
+	Key                   string `xml:"Key"`
+	VersionId             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+	DeleteMarkerVersionId string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+type deleteError struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId,omitempty"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name         `xml:"DeleteResult"`
+	Deleted []*deletedObject `xml:"Deleted"`
+	Errors  []*deleteError   `xml:"Error"`
+}
+
+// deleteObjects handles DeleteObjects requests, which delete up to 1000 keys
+// at once and report the outcome for each key individually.
+
+func (s *Server) deleteObjects(rsp http.ResponseWriter, req *http.Request, bucket string) {
+
+	var d deleteRequest
+
+	err := xml.NewDecoder(req.Body).Decode(&d)
+
+	if err != nil {
+		writeError(rsp, req, "MalformedXML", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(d.Objects) == 0 || len(d.Objects) > 1000 {
+		writeError(rsp, req, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.", http.StatusBadRequest)
+		return
+	}
+
+	result := deleteResult{
+		Deleted: make([]*deletedObject, 0),
+		Errors:  make([]*deleteError, 0),
+	}
+
+	s.mu.Lock()
+
+	for _, o := range d.Objects {
+
+		code, fail := s.deleteFailures[bucket+"/"+o.Key]
+
+		if fail {
+			result.Errors = append(result.Errors, &deleteError{Key: o.Key, VersionId: o.VersionId, Code: code, Message: "Injected failure"})
+			continue
+		}
+
+		deleted := deletedObject{
+			Key:       o.Key,
+			VersionId: o.VersionId,
+		}
+
+		if o.VersionId != "" {
+
+			obj := s.removeVersion(bucket, o.Key, o.VersionId)
+
+			if obj != nil && obj.DeleteMarker {
+				deleted.DeleteMarker = true
+				deleted.DeleteMarkerVersionId = obj.VersionId
+			}
+
+		} else {
+
+			marker := s.remove(bucket, o.Key)
+
+			if marker != nil {
+				deleted.DeleteMarker = true
+				deleted.DeleteMarkerVersionId = marker.VersionId
+			}
+		}
+
+		if !d.Quiet {
+			result.Deleted = append(result.Deleted, &deleted)
+		}
+	}
+
+	s.mu.Unlock()
+
+	writeXML(rsp, http.StatusOK, result)
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type listPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name        `xml:"ListBucketResult"`
+	Name                  string          `xml:"Name"`
+	Prefix                string          `xml:"Prefix"`
+	Delimiter             string          `xml:"Delimiter,omitempty"`
+	MaxKeys               int             `xml:"MaxKeys"`
+	IsTruncated           bool            `xml:"IsTruncated"`
+	Marker                string          `xml:"Marker,omitempty"`
+	NextMarker            string          `xml:"NextMarker,omitempty"`
+	KeyCount              int             `xml:"KeyCount,omitempty"`
+	ContinuationToken     string          `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string          `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string          `xml:"StartAfter,omitempty"`
+	Contents              []*listContents `xml:"Contents"`
+	CommonPrefixes        []*listPrefix   `xml:"CommonPrefixes"`
+}
+
+func (s *Server) listObjects(rsp http.ResponseWriter, req *http.Request, bucket string) {
+
+	q := req.URL.Query()
+
+	v2 := q.Get("list-type") == "2"
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+
+	max_keys := 1000
+
+	str_max := q.Get("max-keys")
+
+	if str_max != "" {
+
+		m, err := strconv.Atoi(str_max)
+
+		if err != nil || m < 0 {
+			writeError(rsp, req, "InvalidArgument", "Invalid max-keys", http.StatusBadRequest)
+			return
+		}
+
+		if m < max_keys {
+			max_keys = m
+		}
+	}
+
+	// in both cases keys are returned in lexical order, after this key
+
+	after := q.Get("marker")
+
+	if v2 {
+
+		after = q.Get("start-after")
+
+		token := q.Get("continuation-token")
+
+		if token != "" {
+			after = token
+		}
+	}
+
+	s.mu.Lock()
+
+	keys := make([]string, 0)
+
+	for k := range s.buckets[bucket] {
+
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	result := listBucketResult{
+		Name:           bucket,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		MaxKeys:        max_keys,
+		Marker:         q.Get("marker"),
+		Contents:       make([]*listContents, 0),
+		CommonPrefixes: make([]*listPrefix, 0),
+	}
+
+	seen_prefixes := make(map[string]bool)
+	count := 0
+	last := ""
+
+	for _, k := range keys {
+
+		if count >= max_keys {
+			result.IsTruncated = true
+			break
+		}
+
+		if delimiter != "" {
+
+			rest := strings.TrimPrefix(k, prefix)
+			idx := strings.Index(rest, delimiter)
+
+			if idx != -1 {
+
+				common := prefix + rest[:idx+len(delimiter)]
+
+				if !seen_prefixes[common] {
+					seen_prefixes[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, &listPrefix{Prefix: common})
+					count += 1
+				}
+
+				last = k
+				continue
+			}
+		}
+
+		obj := s.buckets[bucket][k]
+
+		c := listContents{
+			Key:          k,
+			LastModified: obj.LastModified.UTC().Format(time.RFC3339),
+			ETag:         obj.ETag,
+			Size:         len(obj.Body),
+			StorageClass: "STANDARD",
+		}
+
+		result.Contents = append(result.Contents, &c)
+		count += 1
+		last = k
+	}
+
+	s.mu.Unlock()
+
+	if result.IsTruncated {
+
+		if v2 {
+			result.NextContinuationToken = last
+		} else {
+			result.NextMarker = last
+		}
+	}
+
+	if v2 {
+		result.KeyCount = count
+		result.ContinuationToken = q.Get("continuation-token")
+		result.StartAfter = q.Get("start-after")
+	}
+
+	writeXML(rsp, http.StatusOK, result)
+}
+
+type listVersion struct {
+	Key          string `xml:"Key"`
+	VersionId    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass,omitempty"`
+}
+
+type listVersionsResult struct {
+	XMLName             xml.Name       `xml:"ListVersionsResult"`
+	Name                string         `xml:"Name"`
+	Prefix              string         `xml:"Prefix"`
+	KeyMarker           string         `xml:"KeyMarker"`
+	VersionIdMarker     string         `xml:"VersionIdMarker"`
+	NextKeyMarker       string         `xml:"NextKeyMarker,omitempty"`
+	NextVersionIdMarker string         `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int            `xml:"MaxKeys"`
+	IsTruncated         bool           `xml:"IsTruncated"`
+	Versions            []*listVersion `xml:"Version"`
+	DeleteMarkers       []*listVersion `xml:"DeleteMarker"`
+}
+
+// listObjectVersions handles ListObjectVersions requests. The prefix,
+// key-marker, version-id-marker and max-keys parameters are supported, and
+// the versions of each key are returned newest first. As with S3 a key-marker
+// without a version-id-marker skips every version of that key. Objects in
+// buckets that are not versioned are returned as a single version with the
+// ID "null".
+
+func (s *Server) listObjectVersions(rsp http.ResponseWriter, req *http.Request, bucket string) {
+
+	q := req.URL.Query()
+
+	prefix := q.Get("prefix")
+	key_marker := q.Get("key-marker")
+	version_marker := q.Get("version-id-marker")
+
+	max_keys := 1000
+
+	str_max := q.Get("max-keys")
+
+	if str_max != "" {
+
+		m, err := strconv.Atoi(str_max)
+
+		if err != nil || m < 0 {
+			writeError(rsp, req, "InvalidArgument", "Invalid max-keys", http.StatusBadRequest)
+			return
+		}
+
+		if m < max_keys {
+			max_keys = m
+		}
+	}
+
+	result := listVersionsResult{
+		Name:            bucket,
+		Prefix:          prefix,
+		KeyMarker:       key_marker,
+		VersionIdMarker: version_marker,
+		MaxKeys:         max_keys,
+		Versions:        make([]*listVersion, 0),
+		DeleteMarkers:   make([]*listVersion, 0),
+	}
+
+	s.mu.Lock()
+
+	history, versioned := s.versions[bucket]
+
+	if !versioned {
+
+		history = make(map[string][]*Object)
+
+		for k, obj := range s.buckets[bucket] {
+			history[k] = []*Object{obj}
+		}
+	}
+
+	keys := make([]string, 0)
+
+	for k := range history {
+
+		if strings.HasPrefix(k, prefix) && k >= key_marker {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	count := 0
+
+	// skipping is true until the version after the markers has been reached
+
+	skipping := key_marker != ""
+
+	for _, k := range keys {
+
+		versions := history[k]
+
+		for i := len(versions) - 1; i >= 0; i-- {
+
+			obj := versions[i]
+
+			if skipping {
+
+				if k == key_marker {
+
+					if version_marker != "" && obj.VersionId == version_marker {
+						skipping = false
+					}
+
+					continue
+				}
+
+				skipping = false
+			}
+
+			if count >= max_keys {
+				result.IsTruncated = true
+				break
+			}
+
+			v := listVersion{
+				Key:          k,
+				VersionId:    obj.VersionId,
+				IsLatest:     i == len(versions)-1,
+				LastModified: obj.LastModified.UTC().Format(time.RFC3339Nano),
+			}
+
+			count += 1
+			result.NextKeyMarker = k
+			result.NextVersionIdMarker = obj.VersionId
+
+			if obj.DeleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, &v)
+				continue
+			}
+
+			v.ETag = obj.ETag
+			v.Size = len(obj.Body)
+			v.StorageClass = "STANDARD"
+
+			result.Versions = append(result.Versions, &v)
+		}
+
+		if result.IsTruncated {
+			break
+		}
+	}
+
+	s.mu.Unlock()
+
+	if !result.IsTruncated {
+		result.NextKeyMarker = ""
+		result.NextVersionIdMarker = ""
+	}
+
+	writeXML(rsp, http.StatusOK, result)
+}
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func writeError(rsp http.ResponseWriter, req *http.Request, code string, message string, status int) {
+
+	// HEAD responses don't have a body so aws-sdk-go derives the error
+	// code from the status code (for example "NotFound")
+
+	if req.Method == "HEAD" {
+		rsp.WriteHeader(status)
+		return
+	}
+
+	e := errorResponse{
+		Code:     code,
+		Message:  message,
+		Resource: req.URL.Path,
+	}
+
+	writeXML(rsp, status, e)
+}
+
+func writeXML(rsp http.ResponseWriter, status int, v interface{}) {
+
+	body, err := xml.Marshal(v)
+
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Set("Content-Type", "application/xml")
+	rsp.WriteHeader(status)
+
+	rsp.Write([]byte(xml.Header))
+	rsp.Write(body)
+}
+
+// applyHeaders copies the ACL, content, storage class, tagging, encryption
+// and x-amz-meta-* headers in h to obj. As with S3 the ETags of objects
+// encrypted with SSE-KMS or SSE-C are not the MD5 hash of their contents.
+
+func applyHeaders(obj *Object, h http.Header) {
+
+	obj.ACL = h.Get("x-amz-acl")
+	obj.ContentType = h.Get("Content-Type")
+	obj.ContentEncoding = h.Get("Content-Encoding")
+	obj.CacheControl = h.Get("Cache-Control")
+	obj.ContentDisposition = h.Get("Content-Disposition")
+	obj.StorageClass = h.Get("x-amz-storage-class")
+	obj.Tagging = h.Get("x-amz-tagging")
+	obj.SSE = h.Get("x-amz-server-side-encryption")
+	obj.SSEKMSKeyId = h.Get("x-amz-server-side-encryption-aws-kms-key-id")
+	obj.SSECustomer = h.Get("x-amz-server-side-encryption-customer-algorithm") != ""
+
+	if obj.SSE == "aws:kms" || obj.SSECustomer {
+		enc := md5.Sum(append([]byte(obj.ETag), obj.Body...))
+		obj.ETag = fmt.Sprintf("\"%s\"", hex.EncodeToString(enc[:]))
+	}
+
+	for k, v := range h {
+
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-amz-meta-") && len(v) > 0 {
+			obj.Metadata[strings.TrimPrefix(k, "x-amz-meta-")] = v[0]
+		}
+	}
+}
+
+func newObject(key string, body []byte) *Object {
+
+	enc := md5.Sum(body)
+	etag := fmt.Sprintf("\"%s\"", hex.EncodeToString(enc[:]))
+
+	obj := Object{
+		Key:          key,
+		Body:         body,
+		ETag:         etag,
+		Metadata:     make(map[string]string),
+		LastModified: time.Now(),
+		VersionId:    "null",
+	}
+
+	return &obj
+}
@@ -0,0 +1,98 @@
+package fakes3_test
+
+import (
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"os"
+	"testing"
+)
+
+const testBucket = "data.whosonfirst.org"
+
+func TestListVersionsPages(t *testing.T) {
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "fakes3")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "fakes3")
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	srv.EnableVersioning(testBucket)
+
+	primary := "data/115/932/484/9/1159324849.geojson"
+	alt := "data/115/932/484/9/1159324849-alt-quattroshapes.geojson"
+
+	for i := 0; i < 3; i++ {
+		srv.PutObject(testBucket, primary, []byte(fmt.Sprintf(`{"v":%d}`, i)))
+	}
+
+	srv.PutObject(testBucket, alt, []byte(`{}`))
+	srv.PutObject(testBucket, "data/101/736/545/101736545.geojson", []byte(`{}`))
+
+	cfg, err := s3.NewS3ConfigFromString(srv.DSN(testBucket, "data"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := s3.NewS3Connection(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// which adds a delete marker
+
+	err = conn.Delete("115/932/484/9/1159324849-alt-quattroshapes.geojson")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]string, 0)
+
+	for _, k := range []string{"data/101/736/545/101736545.geojson", alt, primary} {
+
+		versions := srv.Versions(testBucket, k)
+
+		for i := len(versions) - 1; i >= 0; i-- {
+			expected = append(expected, fmt.Sprintf("%s %s", versions[i].Key, versions[i].VersionId))
+		}
+	}
+
+	// 6 versions in pages of 1, 2 (which splits the versions of primary) and
+	// all of them at once should always come back the same way
+
+	for _, max_keys := range []int64{1, 2, 1000} {
+
+		got := make([]string, 0)
+
+		cb := func(v *s3.S3ObjectVersion) error {
+			got = append(got, fmt.Sprintf("%s %s", v.KeyRaw, v.VersionId))
+			return nil
+		}
+
+		opts := s3.DefaultS3ListOptions()
+		opts.MaxKeys = max_keys
+
+		before := srv.Requests("GET")
+
+		err := conn.ListVersions(cb, opts)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages := srv.Requests("GET") - before
+		expected_pages := (len(expected) + int(max_keys) - 1) / int(max_keys)
+
+		if pages != expected_pages {
+			t.Fatalf("Expected %d pages with max keys %d but got %d", expected_pages, max_keys, pages)
+		}
+
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", expected) {
+			t.Fatalf("Unexpected versions with max keys %d, expected %v but got %v", max_keys, expected, got)
+		}
+	}
+}
@@ -3,17 +3,22 @@ module github.com/whosonfirst/go-whosonfirst-s3
 require (
 	github.com/MichaelTJones/walk v0.0.0-20161122175330-4748e29d5718 // indirect
 	github.com/aaronland/go-string v0.1.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/aws/aws-lambda-go v1.11.1
 	github.com/aws/aws-sdk-go v1.20.21
 	github.com/go-ini/ini v1.42.0
 	github.com/go-redis/redis v6.15.2+incompatible
+	github.com/golang/protobuf v1.5.2
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/hashicorp/golang-lru v0.5.1
+	github.com/matttproud/golang_protobuf_extensions v1.0.1
 	github.com/onsi/ginkgo v1.9.0 // indirect
 	github.com/onsi/gomega v1.6.0 // indirect
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.32.1
 	github.com/shaxbee/go-spatialite v0.0.0-20180425212100-9b4c81899e0e // indirect
 	github.com/stretchr/testify v1.3.0
-	github.com/throttled/throttled v2.2.4+incompatible
+	github.com/throttled/throttled v2.2.5+incompatible
 	github.com/whosonfirst/go-whosonfirst-aws v0.1.3
 	github.com/whosonfirst/go-whosonfirst-cli v0.1.0
 	github.com/whosonfirst/go-whosonfirst-crawl v0.1.0
@@ -24,6 +29,7 @@ require (
 	github.com/whosonfirst/go-whosonfirst-sources v0.1.0
 	github.com/whosonfirst/go-whosonfirst-sqlite v0.1.0
 	github.com/whosonfirst/go-whosonfirst-uri v0.1.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/urfave/cli.v1 v1.20.0
 
 )
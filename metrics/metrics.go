@@ -0,0 +1,429 @@
+package metrics
+
+// A very small implementation of the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/) so that long
+// running syncs can be monitored without having to vendor the Prometheus
+// client libraries and all of their dependencies. It only supports what we
+// actually use: counters (optionally with a single label), gauges and
+// histograms.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	go_sync "sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets used for
+// histograms that measure durations.
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(wr io.Writer) error
+}
+
+// Registry is a collection of metrics which can be served over HTTP.
+
+type Registry struct {
+	collectors []collector
+	mu         *go_sync.Mutex
+}
+
+func NewRegistry() *Registry {
+
+	r := Registry{
+		collectors: make([]collector, 0),
+		mu:         new(go_sync.Mutex),
+	}
+
+	return &r
+}
+
+func (r *Registry) register(c collector) {
+
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Write writes every metric in the registry to wr, in the order they were
+// created.
+
+func (r *Registry) Write(wr io.Writer) error {
+
+	r.mu.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(wr)
+
+	for _, c := range collectors {
+
+		err := c.write(buf)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return buf.Flush()
+}
+
+func (r *Registry) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+
+	rsp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	err := r.Write(rsp)
+
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// float64 values that can be updated atomically
+
+type value struct {
+	bits uint64
+}
+
+func (v *value) Add(delta float64) {
+
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+type Counter struct {
+	value
+	name string
+	help string
+}
+
+// NewCounter returns a new counter, which should only ever go up.
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+
+	c := Counter{
+		name: name,
+		help: help,
+	}
+
+	r.register(&c)
+	return &c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) write(wr io.Writer) error {
+
+	err := writeHeader(wr, c.name, c.help, "counter")
+
+	if err != nil {
+		return err
+	}
+
+	return writeSample(wr, c.name, "", c.Value())
+}
+
+// CounterVec is a set of counters that are distinguished by the value of
+// a single label, for example the AWS error code.
+
+type CounterVec struct {
+	name     string
+	help     string
+	label    string
+	counters map[string]*value
+	mu       *go_sync.Mutex
+}
+
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+
+	c := CounterVec{
+		name:     name,
+		help:     help,
+		label:    label,
+		counters: make(map[string]*value),
+		mu:       new(go_sync.Mutex),
+	}
+
+	r.register(&c)
+	return &c
+}
+
+// Add increments the counter whose label is label_value by delta.
+
+func (c *CounterVec) Add(label_value string, delta float64) {
+
+	c.mu.Lock()
+
+	v, ok := c.counters[label_value]
+
+	if !ok {
+		v = new(value)
+		c.counters[label_value] = v
+	}
+
+	c.mu.Unlock()
+
+	v.Add(delta)
+}
+
+func (c *CounterVec) Inc(label_value string) {
+	c.Add(label_value, 1)
+}
+
+func (c *CounterVec) write(wr io.Writer) error {
+
+	err := writeHeader(wr, c.name, c.help, "counter")
+
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+
+	counters := make(map[string]*value, len(c.counters))
+	label_values := make([]string, 0, len(c.counters))
+
+	for k, v := range c.counters {
+		counters[k] = v
+		label_values = append(label_values, k)
+	}
+
+	c.mu.Unlock()
+
+	sort.Strings(label_values)
+
+	for _, k := range label_values {
+
+		labels := fmt.Sprintf("%s=\"%s\"", c.label, escapeLabel(k))
+		err := writeSample(wr, c.name, labels, counters[k].Value())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type Gauge struct {
+	value
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGauge returns a new gauge, which can go up and down.
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+
+	g := Gauge{
+		name: name,
+		help: help,
+	}
+
+	r.register(&g)
+	return &g
+}
+
+// NewGaugeFunc returns a new gauge whose value is whatever fn returns when
+// the registry is written.
+
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) *Gauge {
+
+	g := Gauge{
+		name: name,
+		help: help,
+		fn:   fn,
+	}
+
+	r.register(&g)
+	return &g
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) write(wr io.Writer) error {
+
+	err := writeHeader(wr, g.name, g.help, "gauge")
+
+	if err != nil {
+		return err
+	}
+
+	v := g.Value()
+
+	if g.fn != nil {
+		v = g.fn()
+	}
+
+	return writeSample(wr, g.name, "", v)
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+	mu      *go_sync.Mutex
+}
+
+// NewHistogram returns a new histogram with the upper bounds in buckets. If
+// buckets is empty DefaultBuckets are used.
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	h := Histogram{
+		name:    name,
+		help:    help,
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)),
+		mu:      new(go_sync.Mutex),
+	}
+
+	r.register(&h)
+	return &h
+}
+
+func (h *Histogram) Observe(v float64) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+
+		if v <= upper {
+			h.counts[i] += 1
+		}
+	}
+
+	h.count += 1
+	h.sum += v
+}
+
+func (h *Histogram) write(wr io.Writer) error {
+
+	err := writeHeader(wr, h.name, h.help, "histogram")
+
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+
+	count := h.count
+	sum := h.sum
+
+	h.mu.Unlock()
+
+	bucket := h.name + "_bucket"
+
+	for i, upper := range h.buckets {
+
+		labels := fmt.Sprintf("le=\"%s\"", formatFloat(upper))
+		err := writeSample(wr, bucket, labels, float64(counts[i]))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeSample(wr, bucket, "le=\"+Inf\"", float64(count))
+
+	if err != nil {
+		return err
+	}
+
+	err = writeSample(wr, h.name+"_sum", "", sum)
+
+	if err != nil {
+		return err
+	}
+
+	return writeSample(wr, h.name+"_count", "", float64(count))
+}
+
+func writeHeader(wr io.Writer, name string, help string, metric_type string) error {
+
+	help = strings.Replace(help, "\\", "\\\\", -1)
+	help = strings.Replace(help, "\n", "\\n", -1)
+
+	_, err := fmt.Fprintf(wr, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metric_type)
+	return err
+}
+
+func writeSample(wr io.Writer, name string, labels string, v float64) error {
+
+	if labels != "" {
+		name = fmt.Sprintf("%s{%s}", name, labels)
+	}
+
+	_, err := fmt.Fprintf(wr, "%s %s\n", name, formatFloat(v))
+	return err
+}
+
+func formatFloat(v float64) string {
+
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func escapeLabel(v string) string {
+
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\"", "\\\"", -1)
+	v = strings.Replace(v, "\n", "\\n", -1)
+
+	return v
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bytes"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+
+	r := NewRegistry()
+
+	c := r.NewCounter("test_total", "A counter.")
+	c.Inc()
+	c.Add(2)
+
+	v := r.NewCounterVec("test_errors_total", "A counter with a label.", "code")
+	v.Inc("SlowDown")
+	v.Inc("Access\"Denied")
+	v.Inc("SlowDown")
+
+	g := r.NewGauge("test_in_flight", "A gauge.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	h := r.NewHistogram("test_seconds", "A histogram.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+
+	err := r.Write(&buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# HELP test_total A counter.",
+		"# TYPE test_total counter",
+		"test_total 3",
+		"# TYPE test_errors_total counter",
+		"test_errors_total{code=\"Access\\\"Denied\"} 1",
+		"test_errors_total{code=\"SlowDown\"} 2",
+		"# TYPE test_in_flight gauge",
+		"test_in_flight 1",
+		"# TYPE test_seconds histogram",
+		"test_seconds_bucket{le=\"0.1\"} 1",
+		"test_seconds_bucket{le=\"1\"} 2",
+		"test_seconds_bucket{le=\"+Inf\"} 3",
+		"test_seconds_sum 5.55",
+		"test_seconds_count 3",
+	}
+
+	out := buf.String()
+
+	for _, ln := range expected {
+
+		if !strings.Contains(out, ln+"\n") {
+			t.Fatalf("Missing '%s' in:\n%s", ln, out)
+		}
+	}
+
+	// and make sure Prometheus itself can read it
+
+	var parser expfmt.TextParser
+
+	families, err := parser.TextToMetricFamilies(strings.NewReader(out))
+
+	if err != nil {
+		t.Fatalf("Failed to parse metrics, %s\n%s", err, out)
+	}
+
+	if len(families) != 4 {
+		t.Fatalf("Expected 4 metric families but got %d", len(families))
+	}
+
+	if families["test_total"].GetType() != dto.MetricType_COUNTER || families["test_total"].Metric[0].GetCounter().GetValue() != 3 {
+		t.Fatalf("Unexpected counter: %v", families["test_total"])
+	}
+
+	errors := families["test_errors_total"].Metric
+
+	if len(errors) != 2 || errors[0].Label[0].GetValue() != "Access\"Denied" || errors[1].GetCounter().GetValue() != 2 {
+		t.Fatalf("Unexpected counter vector: %v", families["test_errors_total"])
+	}
+
+	if families["test_in_flight"].GetType() != dto.MetricType_GAUGE || families["test_in_flight"].Metric[0].GetGauge().GetValue() != 1 {
+		t.Fatalf("Unexpected gauge: %v", families["test_in_flight"])
+	}
+
+	hist := families["test_seconds"].Metric[0].GetHistogram()
+
+	if families["test_seconds"].GetType() != dto.MetricType_HISTOGRAM || hist.GetSampleCount() != 3 || hist.GetSampleSum() != 5.55 || len(hist.Bucket) != 3 || hist.Bucket[0].GetCumulativeCount() != 1 {
+		t.Fatalf("Unexpected histogram: %v", families["test_seconds"])
+	}
+}
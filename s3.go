@@ -1 +1,977 @@
 package s3
+
+// This is a fork of the S3Connection code in go-whosonfirst-aws which makes it
+// possible to talk to an S3 (or S3-compatible) service at a custom endpoint,
+// something that the go-whosonfirst-aws code has no hooks for because it sets
+// up its own session. The method signatures are the same except where noted.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-string/dsn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/whosonfirst/go-whosonfirst-aws/session"
+	"github.com/whosonfirst/go-whosonfirst-aws/util"
+	"github.com/whosonfirst/go-whosonfirst-mimetypes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	go_sync "sync"
+	"sync/atomic"
+	"time"
+)
+
+type S3Config struct {
+	Bucket         string
+	Prefix         string
+	Region         string
+	Credentials    string
+	Endpoint       string
+	PathStyle      bool
+	DisableSSL     bool
+	PartSize       int64
+	SSE            string // "AES256" (SSE-S3) or "aws:kms" (SSE-KMS)
+	SSEKMSKeyId    string
+	SSECustomerKey string // a raw 256-bit key for SSE-C
+}
+
+type S3Connection struct {
+	service  *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+	endpoint string
+	sse      string
+	sse_kms  string
+	sse_c    string
+}
+
+type S3ListOptions struct {
+	Timings bool
+	MaxKeys int64
+	Path    string
+}
+
+type S3PutOptions struct {
+	ACL                string
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	StorageClass       string
+	Tags               map[string]string
+	Metadata           map[string]string
+}
+
+type S3Object struct {
+	KeyRaw       string // what aws-sdk-go returns
+	Key          string // KeyRaw but with S3Connection.prefix removed
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+type S3ListCallback func(*S3Object) error
+
+// S3ObjectVersion is a single version of an object in a versioned bucket, or
+// a delete marker. Objects in buckets that have never been versioned have a
+// single version whose VersionId is "null".
+
+type S3ObjectVersion struct {
+	KeyRaw       string
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	DeleteMarker bool
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+type S3VersionsCallback func(*S3ObjectVersion) error
+
+func DefaultS3ListOptions() *S3ListOptions {
+
+	opts := S3ListOptions{
+		Timings: false,
+		MaxKeys: 500,
+	}
+
+	return &opts
+}
+
+// NewS3ConfigFromString parses a go-whosonfirst-aws DSN string. In addition
+// to the usual keys it understands "endpoint", "path-style" and "disable-ssl"
+// for talking to S3-compatible services like MinIO or Ceph, "part-size" for
+// the size, in bytes, of each part in a multipart upload and "sse",
+// "sse-kms-key-id" and "sse-c-key-file" for server-side encryption.
+
+func NewS3ConfigFromString(str_dsn string) (*S3Config, error) {
+
+	dsn_map, err := dsn.StringToDSNWithKeys(str_dsn, "bucket", "region", "credentials")
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := S3Config{
+		Bucket:      dsn_map["bucket"],
+		Region:      dsn_map["region"],
+		Credentials: dsn_map["credentials"],
+	}
+
+	prefix, ok := dsn_map["prefix"]
+
+	if ok {
+		config.Prefix = prefix
+	}
+
+	endpoint, ok := dsn_map["endpoint"]
+
+	if ok {
+		config.Endpoint = endpoint
+	}
+
+	str_part_size, ok := dsn_map["part-size"]
+
+	if ok {
+
+		part_size, err := strconv.ParseInt(str_part_size, 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid part-size value '%s'", str_part_size)
+		}
+
+		config.PartSize = part_size
+	}
+
+	for _, k := range []string{"path-style", "disable-ssl"} {
+
+		str_v, ok := dsn_map[k]
+
+		if !ok {
+			continue
+		}
+
+		v, err := strconv.ParseBool(str_v)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s value '%s'", k, str_v)
+		}
+
+		switch k {
+		case "path-style":
+			config.PathStyle = v
+		case "disable-ssl":
+			config.DisableSSL = v
+		}
+	}
+
+	config.SSE = dsn_map["sse"]
+	config.SSEKMSKeyId = dsn_map["sse-kms-key-id"]
+
+	key_file, ok := dsn_map["sse-c-key-file"]
+
+	if ok {
+
+		key, err := ReadSSECustomerKey(key_file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.SSECustomerKey = key
+	}
+
+	return &config, nil
+}
+
+// ReadSSECustomerKey reads an SSE-C key from path. The file should contain
+// either the raw 256-bit (32 byte) key or the key encoded as base64.
+
+func ReadSSECustomerKey(path string) (string, error) {
+
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(body) == 32 {
+		return string(body), nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("Invalid SSE-C key in %s, it must be 32 bytes (or 32 bytes encoded as base64)", path)
+	}
+
+	return string(key), nil
+}
+
+// validateSSE checks that the server-side encryption settings in s3cfg
+// make sense together.
+
+func validateSSE(s3cfg *S3Config) error {
+
+	switch s3cfg.SSE {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+		// pass
+	default:
+		return fmt.Errorf("Invalid SSE algorithm '%s'. Valid options are: %s, %s", s3cfg.SSE, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+
+	if s3cfg.SSEKMSKeyId != "" && s3cfg.SSE != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("A KMS key ID requires the '%s' SSE algorithm", s3.ServerSideEncryptionAwsKms)
+	}
+
+	if s3cfg.SSECustomerKey != "" && s3cfg.SSE != "" {
+		return errors.New("SSE-C can not be combined with SSE-S3 or SSE-KMS")
+	}
+
+	if s3cfg.SSECustomerKey != "" && len(s3cfg.SSECustomerKey) != 32 {
+		return errors.New("Invalid SSE-C key, it must be 32 bytes")
+	}
+
+	return nil
+}
+
+func NewS3Connection(s3cfg *S3Config) (*S3Connection, error) {
+
+	if s3cfg.Bucket == "" {
+		return nil, errors.New("Invalid S3 bucket name")
+	}
+
+	err := validateSSE(s3cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSessionWithCredentials(s3cfg.Credentials, s3cfg.Region)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aws_cfg := aws.NewConfig()
+
+	if s3cfg.Endpoint != "" {
+		aws_cfg.WithEndpoint(s3cfg.Endpoint)
+	}
+
+	if s3cfg.PathStyle {
+		aws_cfg.WithS3ForcePathStyle(true)
+	}
+
+	if s3cfg.DisableSSL {
+		aws_cfg.WithDisableSSL(true)
+	}
+
+	service := s3.New(sess, aws_cfg)
+
+	uploader := s3manager.NewUploaderWithClient(service)
+
+	if s3cfg.PartSize > 0 {
+
+		if s3cfg.PartSize < s3manager.MinUploadPartSize {
+			return nil, fmt.Errorf("Invalid part size, must be at least %d bytes", s3manager.MinUploadPartSize)
+		}
+
+		uploader.PartSize = s3cfg.PartSize
+	}
+
+	c := S3Connection{
+		service:  service,
+		uploader: uploader,
+		bucket:   s3cfg.Bucket,
+		prefix:   s3cfg.Prefix,
+		endpoint: s3cfg.Endpoint,
+		sse:      s3cfg.SSE,
+		sse_kms:  s3cfg.SSEKMSKeyId,
+		sse_c:    s3cfg.SSECustomerKey,
+	}
+
+	return &c, nil
+}
+
+func (conn *S3Connection) URI(key string) string {
+
+	key = conn.PrepareKey(key)
+
+	if conn.endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(conn.endpoint, "/"), conn.bucket, key)
+	}
+
+	return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", conn.bucket, key)
+}
+
+// PartSize returns the size, in bytes, of each part in a multipart upload.
+// Anything smaller than this is uploaded in a single request.
+
+func (conn *S3Connection) PartSize() int64 {
+	return conn.uploader.PartSize
+}
+
+// Encryption returns the server-side encryption applied to uploads: "AES256",
+// "aws:kms", "SSE-C" or an empty string if none.
+
+func (conn *S3Connection) Encryption() string {
+
+	if conn.sse_c != "" {
+		return "SSE-C"
+	}
+
+	return conn.sse
+}
+
+func (conn *S3Connection) Head(key string) (*s3.HeadObjectOutput, error) {
+
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(conn.bucket),
+		Key:    aws.String(conn.PrepareKey(key)),
+	}
+
+	// SSE-C objects can't be read (or even HEAD-ed) without the key
+
+	if conn.sse_c != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(conn.sse_c)
+	}
+
+	return conn.service.HeadObject(params)
+}
+
+func (conn *S3Connection) Get(key string) (io.ReadCloser, error) {
+
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(conn.bucket),
+		Key:    aws.String(conn.PrepareKey(key)),
+	}
+
+	if conn.sse_c != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(conn.sse_c)
+	}
+
+	rsp, err := conn.service.GetObject(params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Body, nil
+}
+
+// Put uploads fh to key. Unlike go-whosonfirst-aws it does not read options
+// from the fragment of the key but from opts (which may be nil).
+
+func (conn *S3Connection) Put(key string, fh io.ReadCloser, opts *S3PutOptions) error {
+
+	defer fh.Close()
+
+	prepped_key := conn.PrepareKey(key)
+
+	params := s3manager.UploadInput{
+		Bucket: aws.String(conn.bucket),
+		Key:    aws.String(prepped_key),
+		Body:   fh,
+	}
+
+	if conn.sse != "" {
+		params.ServerSideEncryption = aws.String(conn.sse)
+	}
+
+	if conn.sse_kms != "" {
+		params.SSEKMSKeyId = aws.String(conn.sse_kms)
+	}
+
+	if conn.sse_c != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(conn.sse_c)
+	}
+
+	ext := filepath.Ext(prepped_key)
+	types := mimetypes.TypesByExtension(ext)
+
+	if len(types) == 1 {
+		params.ContentType = aws.String(types[0])
+	}
+
+	if opts != nil {
+
+		if opts.ACL != "" {
+			params.ACL = aws.String(opts.ACL)
+		}
+
+		if opts.ContentType != "" {
+			params.ContentType = aws.String(opts.ContentType)
+		}
+
+		if opts.ContentEncoding != "" {
+			params.ContentEncoding = aws.String(opts.ContentEncoding)
+		}
+
+		if opts.CacheControl != "" {
+			params.CacheControl = aws.String(opts.CacheControl)
+		}
+
+		if opts.ContentDisposition != "" {
+			params.ContentDisposition = aws.String(opts.ContentDisposition)
+		}
+
+		if opts.StorageClass != "" {
+			params.StorageClass = aws.String(opts.StorageClass)
+		}
+
+		if len(opts.Tags) > 0 {
+
+			tags := url.Values{}
+
+			for k, v := range opts.Tags {
+				tags.Set(k, v)
+			}
+
+			params.Tagging = aws.String(tags.Encode())
+		}
+
+		if len(opts.Metadata) > 0 {
+			params.Metadata = aws.StringMap(opts.Metadata)
+		}
+	}
+
+	_, err := conn.uploader.Upload(&params)
+	return err
+}
+
+// Copy copies the object for src_key in src, which may be conn itself, to key
+// using a server-side copy so nothing is downloaded. The object's metadata,
+// including its content type, is copied as-is but, as with S3, its ACL is not
+// so the ACL in opts (which may be nil) is applied instead. It returns the
+// ETag of the new object.
+
+func (conn *S3Connection) Copy(src *S3Connection, src_key string, key string, opts *S3PutOptions) (string, error) {
+
+	// the copy source needs to be URL encoded but the slashes separating
+	// the bucket and key (and the key's "directories") don't
+
+	segments := strings.Split(src.bucket+"/"+src.PrepareKey(src_key), "/")
+
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+
+	params := &s3.CopyObjectInput{
+		Bucket:     aws.String(conn.bucket),
+		Key:        aws.String(conn.PrepareKey(key)),
+		CopySource: aws.String(strings.Join(segments, "/")),
+	}
+
+	if conn.sse != "" {
+		params.ServerSideEncryption = aws.String(conn.sse)
+	}
+
+	if conn.sse_kms != "" {
+		params.SSEKMSKeyId = aws.String(conn.sse_kms)
+	}
+
+	if conn.sse_c != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(conn.sse_c)
+	}
+
+	if src.sse_c != "" {
+		params.CopySourceSSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.CopySourceSSECustomerKey = aws.String(src.sse_c)
+	}
+
+	if opts != nil && opts.ACL != "" {
+		params.ACL = aws.String(opts.ACL)
+	}
+
+	rsp, err := conn.service.CopyObject(params)
+
+	if err != nil {
+		return "", err
+	}
+
+	etag := ""
+
+	if rsp.CopyObjectResult != nil {
+		etag = aws.StringValue(rsp.CopyObjectResult.ETag)
+	}
+
+	return etag, nil
+}
+
+func (conn *S3Connection) Delete(key string) error {
+
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(conn.bucket),
+		Key:    aws.String(conn.PrepareKey(key)),
+	}
+
+	_, err := conn.service.DeleteObject(params)
+	return err
+}
+
+// MaxDeleteKeys is the maximum number of keys that can be deleted by a single
+// DeleteObjects request.
+
+const MaxDeleteKeys = 1000
+
+// S3DeleteError is the reason that DeleteMany failed to delete a single key.
+
+type S3DeleteError struct {
+	Key       string
+	VersionId string // only set by DeleteVersions
+	Code      string
+	Message   string
+}
+
+func (e *S3DeleteError) Error() string {
+
+	if e.VersionId != "" {
+		return fmt.Sprintf("Failed to delete %s (version %s): %s (%s)", e.Key, e.VersionId, e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("Failed to delete %s: %s (%s)", e.Key, e.Code, e.Message)
+}
+
+// DeleteMany deletes keys using DeleteObjects requests of up to MaxDeleteKeys
+// keys each, running up to workers requests at a time. It returns an error
+// for every key that could not be deleted, either because S3 said so in its
+// response or because the entire request failed. Keys that don't exist are
+// not errors.
+
+func (conn *S3Connection) DeleteMany(keys []string, workers int) []*S3DeleteError {
+
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+
+	for i, key := range keys {
+
+		objects[i] = &s3.ObjectIdentifier{
+			Key: aws.String(conn.PrepareKey(key)),
+		}
+	}
+
+	return conn.deleteObjects(objects, workers)
+}
+
+// DeleteVersions permanently deletes versions, which may include delete
+// markers, in the same way that DeleteMany deletes keys. Deleting the latest
+// version of an object makes the version before it (if any) the current one
+// so deleting a delete marker "undeletes" an object.
+
+func (conn *S3Connection) DeleteVersions(versions []*S3ObjectVersion, workers int) []*S3DeleteError {
+
+	objects := make([]*s3.ObjectIdentifier, len(versions))
+
+	for i, v := range versions {
+
+		objects[i] = &s3.ObjectIdentifier{
+			Key:       aws.String(conn.PrepareKey(v.Key)),
+			VersionId: aws.String(v.VersionId),
+		}
+	}
+
+	return conn.deleteObjects(objects, workers)
+}
+
+func (conn *S3Connection) deleteObjects(objects []*s3.ObjectIdentifier, workers int) []*S3DeleteError {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	failures := make([]*S3DeleteError, 0)
+	mu := new(go_sync.Mutex)
+
+	wg := new(go_sync.WaitGroup)
+	throttle := make(chan bool, workers)
+
+	for start := 0; start < len(objects); start += MaxDeleteKeys {
+
+		end := start + MaxDeleteKeys
+
+		if end > len(objects) {
+			end = len(objects)
+		}
+
+		wg.Add(1)
+		throttle <- true
+
+		go func(batch []*s3.ObjectIdentifier) {
+
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+
+			errs := conn.deleteBatch(batch)
+
+			if len(errs) > 0 {
+				mu.Lock()
+				failures = append(failures, errs...)
+				mu.Unlock()
+			}
+
+		}(objects[start:end])
+	}
+
+	wg.Wait()
+
+	return failures
+}
+
+func (conn *S3Connection) deleteBatch(objects []*s3.ObjectIdentifier) []*S3DeleteError {
+
+	// quiet mode means that only keys that couldn't be deleted are
+	// included in the response
+
+	params := &s3.DeleteObjectsInput{
+		Bucket: aws.String(conn.bucket),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	}
+
+	rsp, err := conn.service.DeleteObjects(params)
+
+	if err != nil {
+
+		code := "RequestFailed"
+
+		if aws_err, ok := err.(awserr.Error); ok {
+			code = aws_err.Code()
+		}
+
+		failures := make([]*S3DeleteError, len(objects))
+
+		for i, o := range objects {
+
+			failures[i] = &S3DeleteError{
+				Key:       conn.trimPrefix(aws.StringValue(o.Key)),
+				VersionId: aws.StringValue(o.VersionId),
+				Code:      code,
+				Message:   err.Error(),
+			}
+		}
+
+		return failures
+	}
+
+	failures := make([]*S3DeleteError, 0)
+
+	for _, e := range rsp.Errors {
+
+		code := aws.StringValue(e.Code)
+
+		if code == s3.ErrCodeNoSuchKey || code == "NoSuchVersion" {
+			continue
+		}
+
+		f := S3DeleteError{
+			Key:       conn.trimPrefix(aws.StringValue(e.Key)),
+			VersionId: aws.StringValue(e.VersionId),
+			Code:      code,
+			Message:   aws.StringValue(e.Message),
+		}
+
+		failures = append(failures, &f)
+	}
+
+	return failures
+}
+
+// DeleteRecursive deletes every object "inside" path, treating it as a
+// directory, followed by path itself, using DeleteMany.
+
+func (conn *S3Connection) DeleteRecursive(path string) error {
+
+	keys := make([]string, 0)
+	mu := new(go_sync.Mutex)
+
+	cb := func(obj *S3Object) error {
+
+		if obj.Key == path {
+			return nil
+		}
+
+		mu.Lock()
+		keys = append(keys, obj.Key)
+		mu.Unlock()
+
+		return nil
+	}
+
+	opts := DefaultS3ListOptions()
+	opts.Path = strings.TrimRight(path, "/") + "/"
+
+	err := conn.List(cb, opts)
+
+	if err != nil {
+		return err
+	}
+
+	keys = append(keys, path)
+
+	failures := conn.DeleteMany(keys, 1)
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to delete %d keys, for example %s (%s)", len(failures), failures[0].Key, failures[0].Code)
+	}
+
+	return nil
+}
+
+// List invokes cb for every object whose key starts with opts.Path. The
+// objects in each page of results are processed concurrently. Unlike
+// go-whosonfirst-aws the first error returned by cb stops the listing
+// and is returned.
+
+func (conn *S3Connection) List(cb S3ListCallback, opts *S3ListOptions) error {
+
+	count_pages := int64(0)
+	count_items := int64(0)
+
+	if opts.Timings {
+
+		done_ch := make(chan bool)
+		ticker := time.NewTicker(time.Second * 10)
+
+		defer func() {
+			ticker.Stop()
+			done_ch <- true
+		}()
+
+		go func() {
+
+			for {
+				select {
+				case <-done_ch:
+					return
+				case <-ticker.C:
+					log.Printf("items %d pages %d\n", atomic.LoadInt64(&count_items), atomic.LoadInt64(&count_pages))
+				}
+			}
+		}()
+
+		t1 := time.Now()
+
+		defer func() {
+			log.Printf("time to list items %d %v\n", atomic.LoadInt64(&count_items), time.Since(t1))
+		}()
+	}
+
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(conn.bucket),
+		Prefix:  aws.String(conn.listPrefix(opts)),
+		MaxKeys: aws.Int64(opts.MaxKeys),
+	}
+
+	var list_err error
+
+	aws_cb := func(rsp *s3.ListObjectsV2Output, last_page bool) bool {
+
+		atomic.AddInt64(&count_pages, 1)
+
+		wg := new(go_sync.WaitGroup)
+		mu := new(go_sync.Mutex)
+
+		for _, aws_obj := range rsp.Contents {
+
+			atomic.AddInt64(&count_items, 1)
+
+			key_raw := aws.StringValue(aws_obj.Key)
+
+			obj := &S3Object{
+				KeyRaw:       key_raw,
+				Key:          conn.trimPrefix(key_raw),
+				Size:         aws.Int64Value(aws_obj.Size),
+				ETag:         aws.StringValue(aws_obj.ETag),
+				LastModified: aws.TimeValue(aws_obj.LastModified),
+			}
+
+			wg.Add(1)
+
+			go func(obj *S3Object) {
+
+				defer wg.Done()
+
+				err := cb(obj)
+
+				if err != nil {
+
+					mu.Lock()
+
+					if list_err == nil {
+						list_err = fmt.Errorf("failed to process %s because %s", obj.Key, err)
+					}
+
+					mu.Unlock()
+				}
+
+			}(obj)
+		}
+
+		wg.Wait()
+
+		return list_err == nil
+	}
+
+	err := conn.service.ListObjectsV2Pages(params, aws_cb)
+
+	if err != nil {
+		return err
+	}
+
+	return list_err
+}
+
+// ListVersions invokes cb for every version, including delete markers, of
+// every object whose key starts with opts.Path. Unlike List, cb is invoked
+// sequentially and in order: by key and then newest version first.
+
+func (conn *S3Connection) ListVersions(cb S3VersionsCallback, opts *S3ListOptions) error {
+
+	params := &s3.ListObjectVersionsInput{
+		Bucket:  aws.String(conn.bucket),
+		Prefix:  aws.String(conn.listPrefix(opts)),
+		MaxKeys: aws.Int64(opts.MaxKeys),
+	}
+
+	var list_err error
+
+	aws_cb := func(rsp *s3.ListObjectVersionsOutput, last_page bool) bool {
+
+		// S3 returns versions and delete markers separately so put them
+		// back in order
+
+		versions := make([]*S3ObjectVersion, 0)
+
+		for _, aws_v := range rsp.Versions {
+
+			key_raw := aws.StringValue(aws_v.Key)
+
+			v := &S3ObjectVersion{
+				KeyRaw:       key_raw,
+				Key:          conn.trimPrefix(key_raw),
+				VersionId:    aws.StringValue(aws_v.VersionId),
+				IsLatest:     aws.BoolValue(aws_v.IsLatest),
+				Size:         aws.Int64Value(aws_v.Size),
+				ETag:         aws.StringValue(aws_v.ETag),
+				LastModified: aws.TimeValue(aws_v.LastModified),
+			}
+
+			versions = append(versions, v)
+		}
+
+		for _, aws_m := range rsp.DeleteMarkers {
+
+			key_raw := aws.StringValue(aws_m.Key)
+
+			v := &S3ObjectVersion{
+				KeyRaw:       key_raw,
+				Key:          conn.trimPrefix(key_raw),
+				VersionId:    aws.StringValue(aws_m.VersionId),
+				IsLatest:     aws.BoolValue(aws_m.IsLatest),
+				DeleteMarker: true,
+				LastModified: aws.TimeValue(aws_m.LastModified),
+			}
+
+			versions = append(versions, v)
+		}
+
+		sort.SliceStable(versions, func(i, j int) bool {
+
+			if versions[i].KeyRaw != versions[j].KeyRaw {
+				return versions[i].KeyRaw < versions[j].KeyRaw
+			}
+
+			if versions[i].IsLatest != versions[j].IsLatest {
+				return versions[i].IsLatest
+			}
+
+			return versions[i].LastModified.After(versions[j].LastModified)
+		})
+
+		for _, v := range versions {
+
+			err := cb(v)
+
+			if err != nil {
+				list_err = fmt.Errorf("failed to process %s (version %s) because %s", v.Key, v.VersionId, err)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	err := conn.service.ListObjectVersionsPages(params, aws_cb)
+
+	if err != nil {
+		return err
+	}
+
+	return list_err
+}
+
+// listPrefix returns the (complete) prefix to list for opts.
+
+func (conn *S3Connection) listPrefix(opts *S3ListOptions) string {
+
+	prefix := conn.prefix
+
+	if opts.Path != "" {
+
+		prefix = filepath.Join(prefix, opts.Path)
+
+		// filepath.Join removes trailing slashes but they matter here
+		// because "115/932/484/9/" is not the same prefix as "115/932/484/9"
+
+		if strings.HasSuffix(opts.Path, "/") {
+			prefix = prefix + "/"
+		}
+	}
+
+	return prefix
+}
+
+func (conn *S3Connection) PrepareKey(key string) string {
+
+	if strings.TrimSpace(conn.prefix) == "" {
+		return key
+	}
+
+	return filepath.Join(conn.prefix, key)
+}
+
+func (conn *S3Connection) trimPrefix(key string) string {
+
+	if conn.prefix == "" {
+		return key
+	}
+
+	return strings.TrimPrefix(key, fmt.Sprintf("%s/", conn.prefix))
+}
+
+// IsNotFound reports whether err is an S3 "key does not exist" error. S3
+// reports these as "NotFound" for HEAD requests and "NoSuchKey" for everything
+// else.
+
+func IsNotFound(err error) bool {
+	return util.IsAWSErrorWithCode(err, s3.ErrCodeNoSuchKey) || util.IsAWSErrorWithCode(err, "NotFound")
+}
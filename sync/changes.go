@@ -0,0 +1,182 @@
+package sync
+
+// ChangeDetector decides whether a local file is different from its remote
+// counterpart. The naive approach, and what we used to do, is to compare the
+// MD5 hash of the local file with the ETag of the remote object but that only
+// works for objects that were uploaded in a single PUT request without SSE-KMS
+// encryption. Objects that were uploaded in multiple parts have an ETag that is
+// the MD5 hash of the (binary) MD5 hashes of each part followed by "-" and the
+// number of parts; that can be recomputed if we know the part size. Objects
+// that have a "sha256" metadata value (which SyncFile writes) are compared
+// using that instead, which also takes care of SSE-KMS and SSE-C encrypted
+// objects whose ETags are not MD5 hashes at all. If files are being
+// compressed before they are uploaded then it is the compressed body that is
+// compared with the ETag and objects whose Content-Encoding is different have
+// always changed.
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"strconv"
+	"strings"
+)
+
+// MetadataSHA256 is the metadata key for the SHA-256 hash of an object's body.
+
+const MetadataSHA256 = "sha256"
+
+// partSizer is implemented by targets that upload large objects in parts.
+
+type partSizer interface {
+	PartSize() int64
+}
+
+type ChangeDetector struct {
+	PartSize int64
+	Encoding string // the compression applied to bodies before they are uploaded
+	// OpaqueETags means that the ETags of objects whose encryption is not
+	// known (for example because they come from a listing) can not be
+	// assumed to be MD5 hashes
+	OpaqueETags bool
+}
+
+// NewChangeDetector returns a ChangeDetector for objects uploaded with
+// part_size byte parts. If part_size is less than 1 the aws-sdk-go default
+// (5MB) is used.
+
+func NewChangeDetector(part_size int64) *ChangeDetector {
+
+	if part_size < 1 {
+		part_size = s3manager.DefaultUploadPartSize
+	}
+
+	d := ChangeDetector{
+		PartSize: part_size,
+	}
+
+	return &d
+}
+
+// HasChanged reports whether body is different from remote.
+
+func (d *ChangeDetector) HasChanged(body []byte, remote *TargetObject) bool {
+
+	remote_sha, ok := remote.Metadata[MetadataSHA256]
+
+	if ok && remote_sha != "" {
+
+		// the SHA-256 hash is always of the uncompressed body, so
+		// check that the object has been compressed the same way
+
+		if remote.ContentEncoding != d.Encoding {
+			return true
+		}
+
+		return SHA256Hex(body) != remote_sha
+	}
+
+	if !d.etagIsHash(remote) {
+		return true
+	}
+
+	if d.Encoding != "" {
+
+		compressed, err := compress(body, d.Encoding)
+
+		if err != nil {
+			return true
+		}
+
+		body = compressed
+	}
+
+	if IsMultipartETag(remote.ETag) {
+		return MultipartETag(body, d.PartSize) != remote.ETag
+	}
+
+	return MD5Hex(body) != remote.ETag
+}
+
+// CanCompare reports whether HasChanged can say anything meaningful about
+// remote, which it can't if remote has no SHA-256 hash and its ETag is not
+// an MD5 hash. In that case HasChanged always reports that body has changed.
+
+func (d *ChangeDetector) CanCompare(remote *TargetObject) bool {
+
+	remote_sha, ok := remote.Metadata[MetadataSHA256]
+
+	if ok && remote_sha != "" {
+		return true
+	}
+
+	return d.etagIsHash(remote)
+}
+
+// etagIsHash reports whether the ETag of remote is derived from (the MD5 hash
+// of) its contents, which it isn't for objects encrypted with SSE-KMS or SSE-C.
+
+func (d *ChangeDetector) etagIsHash(remote *TargetObject) bool {
+
+	switch remote.Encryption {
+	case "aws:kms", "SSE-C":
+		return false
+	case "":
+		return !d.OpaqueETags
+	default:
+		return true
+	}
+}
+
+// IsMultipartETag reports whether etag (without the surrounding quotes) is
+// the ETag of an object that was uploaded in multiple parts.
+
+func IsMultipartETag(etag string) bool {
+
+	parts := strings.Split(etag, "-")
+
+	if len(parts) != 2 {
+		return false
+	}
+
+	_, err := strconv.Atoi(parts[1])
+	return err == nil
+}
+
+// MultipartETag returns the ETag that S3 would assign to body if it were
+// uploaded in part_size byte parts.
+
+func MultipartETag(body []byte, part_size int64) string {
+
+	size := int64(len(body))
+	hashes := make([]byte, 0)
+	count := 0
+
+	for offset := int64(0); offset < size; offset += part_size {
+
+		end := offset + part_size
+
+		if end > size {
+			end = size
+		}
+
+		enc := md5.Sum(body[offset:end])
+		hashes = append(hashes, enc[:]...)
+		count += 1
+	}
+
+	enc := md5.Sum(hashes)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(enc[:]), count)
+}
+
+func MD5Hex(body []byte) string {
+	enc := md5.Sum(body)
+	return hex.EncodeToString(enc[:])
+}
+
+func SHA256Hex(body []byte) string {
+	enc := sha256.Sum256(body)
+	return hex.EncodeToString(enc[:])
+}
@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestChangeDetector(t *testing.T) {
+
+	d := NewChangeDetector(0)
+
+	body := testFeature(101736545, "Montreal")
+	other := testFeature(101736545, "Montréal")
+
+	obj := &TargetObject{
+		ETag: MD5Hex(body),
+	}
+
+	if d.HasChanged(body, obj) {
+		t.Fatal("Expected body to be unchanged")
+	}
+
+	if !d.HasChanged(other, obj) {
+		t.Fatal("Expected other to be changed")
+	}
+
+	// the SHA-256 hash takes precedence over the ETag (for example because
+	// the object is encrypted with SSE-KMS)
+
+	obj = &TargetObject{
+		ETag: "not-an-md5-hash",
+		Metadata: map[string]string{
+			MetadataSHA256: SHA256Hex(body),
+		},
+	}
+
+	if d.HasChanged(body, obj) {
+		t.Fatal("Expected body to be unchanged using SHA-256")
+	}
+
+	if !d.HasChanged(other, obj) {
+		t.Fatal("Expected other to be changed using SHA-256")
+	}
+}
+
+func TestChangeDetectorMultipart(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	part_size := int64(5 * 1024 * 1024)
+
+	s3_t, err := NewS3TargetFromDSN(fmt.Sprintf("%s part-size=%d", srv.DSN(testBucket, "data"), part_size))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("0123456789"), int(part_size*2/10)+1)
+	key := "sqlite/whosonfirst-data-latest.db"
+
+	err = s3_t.Put(key, ioutil.NopCloser(bytes.NewReader(body)), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s3_t.Head(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsMultipartETag(obj.ETag) || !strings.HasSuffix(obj.ETag, "-3") {
+		t.Fatalf("Expected a 3 part multipart ETag but got '%s'", obj.ETag)
+	}
+
+	d := NewChangeDetector(s3_t.PartSize())
+
+	if d.HasChanged(body, obj) {
+		t.Fatal("Expected body to be unchanged")
+	}
+
+	changed := make([]byte, len(body))
+	copy(changed, body)
+	changed[0] = 'X'
+
+	if !d.HasChanged(changed, obj) {
+		t.Fatal("Expected changed body to be changed")
+	}
+
+	// without the right part size there's no way to tell
+
+	if !NewChangeDetector(part_size*2).HasChanged(body, obj) {
+		t.Fatal("Expected body to be changed with the wrong part size")
+	}
+}
@@ -0,0 +1,269 @@
+package sync
+
+// A Checkpoint is a record of the (local) paths that a RemoteSync has
+// confirmed are synced, which is to say that they were either uploaded or
+// found to be unchanged, so that a sync that dies part way through can be
+// restarted without having to check everything all over again. Checkpoints
+// are append-only files: the first line is a JSON header recording the git
+// commit of the data being synced, if known, and every line after that is a
+// path. Paths are buffered and written to disk periodically.
+//
+// A checkpoint for a different commit is out of date, since any of its paths
+// may have changed, so it is discarded. Checkpoints without a commit are
+// always trusted.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	go_sync "sync"
+	"time"
+)
+
+// DefaultCheckpointInterval is how often paths are written to a checkpoint
+// file if no other interval is specified.
+
+const DefaultCheckpointInterval = 30 * time.Second
+
+type checkpointHeader struct {
+	Commit  string    `json:"commit,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Checkpoint struct {
+	path     string
+	commit   string
+	interval time.Duration
+	paths    map[string]bool
+	fh       *os.File
+	wr       *bufio.Writer
+	flushed  time.Time
+	mu       *go_sync.Mutex
+}
+
+// OpenCheckpoint opens the checkpoint file at path for commit (which may be
+// empty), creating it if it doesn't exist or if it is for a different commit.
+// If reset is true any existing checkpoint is discarded.
+
+func OpenCheckpoint(path string, commit string, interval time.Duration, reset bool) (*Checkpoint, error) {
+
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+
+	cp := Checkpoint{
+		path:     path,
+		commit:   commit,
+		interval: interval,
+		paths:    make(map[string]bool),
+		flushed:  time.Now(),
+		mu:       new(go_sync.Mutex),
+	}
+
+	if !reset {
+
+		ok, err := cp.read()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+
+			fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+
+			if err != nil {
+				return nil, err
+			}
+
+			cp.fh = fh
+			cp.wr = bufio.NewWriter(fh)
+
+			return &cp, nil
+		}
+	}
+
+	fh, err := os.Create(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cp.fh = fh
+	cp.wr = bufio.NewWriter(fh)
+
+	hdr := checkpointHeader{
+		Commit:  commit,
+		Created: time.Now(),
+	}
+
+	err = json.NewEncoder(cp.wr).Encode(&hdr)
+
+	if err == nil {
+		err = cp.wr.Flush()
+	}
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	return &cp, nil
+}
+
+// read loads the paths in an existing checkpoint file, returning false if
+// there isn't one or it is for a different commit.
+
+func (cp *Checkpoint) read() (bool, error) {
+
+	fh, err := os.Open(cp.path)
+
+	if err != nil {
+
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		return false, scanner.Err()
+	}
+
+	var hdr checkpointHeader
+
+	err = json.Unmarshal(scanner.Bytes(), &hdr)
+
+	if err != nil {
+		return false, errors.New("Invalid checkpoint header")
+	}
+
+	if hdr.Commit != cp.commit {
+		return false, nil
+	}
+
+	for scanner.Scan() {
+
+		// a partially written last line will never match a real path
+		// so there's no need to worry about it
+
+		ln := strings.TrimSpace(scanner.Text())
+
+		if ln != "" {
+			cp.paths[ln] = true
+		}
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Has reports whether path has already been confirmed synced.
+
+func (cp *Checkpoint) Has(path string) bool {
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.paths[path]
+}
+
+func (cp *Checkpoint) Len() int {
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return len(cp.paths)
+}
+
+// Add records that path has been confirmed synced, writing it (and anything
+// else that has been added since) to disk if it has been more than the
+// checkpoint interval since that last happened.
+
+func (cp *Checkpoint) Add(path string) error {
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.paths[path] {
+		return nil
+	}
+
+	cp.paths[path] = true
+
+	_, err := cp.wr.WriteString(path + "\n")
+
+	if err != nil {
+		return err
+	}
+
+	if time.Since(cp.flushed) < cp.interval {
+		return nil
+	}
+
+	return cp.flush()
+}
+
+// Flush writes any paths that have been added to disk.
+
+func (cp *Checkpoint) Flush() error {
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.flush()
+}
+
+func (cp *Checkpoint) flush() error {
+
+	cp.flushed = time.Now()
+
+	err := cp.wr.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	return cp.fh.Sync()
+}
+
+// Close flushes and closes the checkpoint file. If remove is true, for
+// example because the sync completed successfully, the file is removed.
+
+func (cp *Checkpoint) Close(remove bool) error {
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	err := cp.flush()
+
+	if err != nil {
+		cp.fh.Close()
+		return err
+	}
+
+	err = cp.fh.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if remove {
+		return os.Remove(cp.path)
+	}
+
+	return nil
+}
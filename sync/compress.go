@@ -0,0 +1,134 @@
+package sync
+
+// Records can be compressed before they are uploaded, and stored with the
+// appropriate Content-Encoding header, so that a CDN serving them straight
+// from the bucket only has to pay for compressed bytes. Compression is
+// deterministic (gzip headers don't include a timestamp) so the same body
+// always produces the same compressed bytes, and ETag. The same is true of
+// Brotli, which compresses GeoJSON better but is slower. Records that are
+// pulled are decompressed according to their Content-Encoding before they
+// are written to disk.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	CompressGzip   = "gzip"
+	CompressBrotli = "br"
+)
+
+func ValidCompressions() []string {
+
+	valid := []string{
+		CompressGzip,
+		CompressBrotli,
+	}
+
+	return valid
+}
+
+// ensureCompression returns an error if encoding is not a valid compression
+// scheme. An empty string means no compression.
+
+func ensureCompression(encoding string) error {
+
+	switch encoding {
+	case "", CompressGzip, CompressBrotli:
+		return nil
+	default:
+		return fmt.Errorf("Invalid compression '%s'. Valid options are: %s", encoding, strings.Join(ValidCompressions(), ", "))
+	}
+}
+
+// compress returns body compressed using encoding.
+
+func compress(body []byte, encoding string) ([]byte, error) {
+
+	err := ensureCompression(encoding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding == "" {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	var wr io.WriteCloser
+
+	switch encoding {
+	case CompressBrotli:
+		wr = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	default:
+
+		gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+
+		if err != nil {
+			return nil, err
+		}
+
+		wr = gz
+	}
+
+	_, err = wr.Write(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = wr.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// gzipMagic is the first two bytes of every gzip stream.
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompress returns body, which was stored with the Content-Encoding encoding,
+// decompressed. Go's HTTP client transparently decompresses gzip responses so
+// gzip bodies that don't start with the gzip magic number are assumed to have
+// been decompressed already (GeoJSON never starts with those bytes).
+
+func decompress(body []byte, encoding string) ([]byte, error) {
+
+	var rd io.Reader
+
+	switch encoding {
+	case "":
+		return body, nil
+	case CompressGzip:
+
+		if !bytes.HasPrefix(body, gzipMagic) {
+			return body, nil
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+		rd = gz
+
+	case CompressBrotli:
+		rd = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding '%s'", encoding)
+	}
+
+	return ioutil.ReadAll(rd)
+}
@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/aaronland/go-string/dsn"
+	"net/url"
+)
+
+// EncryptionOptions are the server-side encryption settings for an S3 target.
+// They are the equivalent of the "sse", "sse-kms-key-id" and "sse-c-key-file"
+// DSN keys (or s3:// URI parameters) and are merged with them, with anything
+// already set in a DSN or URI taking precedence.
+
+type EncryptionOptions struct {
+	SSE             string // "AES256" (SSE-S3) or "aws:kms" (SSE-KMS)
+	KMSKeyId        string
+	CustomerKeyFile string // the path to a file containing an SSE-C key
+}
+
+// encryptedTarget is implemented by targets that encrypt objects on upload.
+
+type encryptedTarget interface {
+	Encryption() string
+}
+
+// hasOpaqueETags reports whether objects uploaded to t have ETags that are not
+// MD5 hashes because they are encrypted with SSE-KMS or SSE-C.
+
+func hasOpaqueETags(t Target) bool {
+
+	et, ok := t.(encryptedTarget)
+
+	if !ok {
+		return false
+	}
+
+	switch et.Encryption() {
+	case "aws:kms", "SSE-C":
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *EncryptionOptions) keys() map[string]string {
+
+	keys := make(map[string]string)
+
+	if e.SSE != "" {
+		keys["sse"] = e.SSE
+	}
+
+	if e.KMSKeyId != "" {
+		keys["sse-kms-key-id"] = e.KMSKeyId
+	}
+
+	if e.CustomerKeyFile != "" {
+		keys["sse-c-key-file"] = e.CustomerKeyFile
+	}
+
+	return keys
+}
+
+// mergeDSN adds the encryption settings in e to str_dsn, unless they are
+// already set.
+
+func (e *EncryptionOptions) mergeDSN(str_dsn string) (string, error) {
+
+	dsn_map, err := dsn.StringToDSN(str_dsn)
+
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range e.keys() {
+
+		_, ok := dsn_map[k]
+
+		if !ok {
+			dsn_map[k] = v
+		}
+	}
+
+	return dsn_map.String(), nil
+}
+
+// mergeURI adds the encryption settings in e to the query parameters of
+// str_uri, unless they are already set. Only s3:// targets support
+// server-side encryption so anything else is an error, rather than quietly
+// storing records unencrypted.
+
+func (e *EncryptionOptions) mergeURI(str_uri string) (string, error) {
+
+	u, err := url.Parse(str_uri)
+
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "s3" {
+		return "", fmt.Errorf("Server-side encryption is only supported by s3:// targets, not %s:// targets", u.Scheme)
+	}
+
+	q := u.Query()
+
+	for k, v := range e.keys() {
+
+		if q.Get(k) == "" {
+			q.Set(k, v)
+		}
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,377 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	go_sync "sync"
+	"sync/atomic"
+)
+
+// GitDiff is the set of files in the "data" directory of a (local) git
+// repository that were changed or deleted between two commits.
+
+type GitDiff struct {
+	Repo    string
+	Since   string   // the commit hash of the older commit
+	Until   string   // the commit hash of the newer commit
+	Changed []string // paths, relative to Repo, that were added or modified
+	Deleted []string // paths, relative to Repo, that were deleted
+}
+
+// NewGitDiff returns the files that changed in repo between the since and
+// until commits (or anything else git understands, like HEAD~1 or a tag).
+// Renames are treated as a deletion and an addition.
+
+func NewGitDiff(repo string, since string, until string) (*GitDiff, error) {
+
+	since_commit, err := GitResolve(repo, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	until_commit, err := GitResolve(repo, until)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := git(repo, "diff", "--name-status", "--no-renames", "-z", since_commit, until_commit, "--", "data")
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := GitDiff{
+		Repo:    repo,
+		Since:   since_commit,
+		Until:   until_commit,
+		Changed: make([]string, 0),
+		Deleted: make([]string, 0),
+	}
+
+	// output looks like {STATUS}\0{PATH}\0{STATUS}\0{PATH}\0...
+
+	fields := strings.Split(strings.TrimRight(string(out), "\x00"), "\x00")
+
+	if len(fields) == 1 && fields[0] == "" {
+		return &d, nil
+	}
+
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("Unexpected output from git diff: %q", out)
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+
+		status := fields[i]
+		path := fields[i+1]
+
+		switch status[0] {
+		case 'A', 'M', 'T':
+			d.Changed = append(d.Changed, path)
+		case 'D':
+			d.Deleted = append(d.Deleted, path)
+		default:
+			return nil, fmt.Errorf("Unexpected status '%s' for %s", status, path)
+		}
+	}
+
+	return &d, nil
+}
+
+// GitCommit returns the commit hash of HEAD in the git repository at repo.
+
+func GitCommit(repo string) (string, error) {
+	return GitResolve(repo, "HEAD")
+}
+
+// GitResolve returns the commit hash for rev in the git repository at repo.
+
+func GitResolve(repo string, rev string) (string, error) {
+
+	out, err := git(repo, "rev-parse", "--verify", rev+"^{commit}")
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// SyncGitDiff syncs the WOF records that were changed in d, reading them
+// from the git repository (as of d.Until) rather than the working tree, and
+// deletes the remote objects for records that were deleted. Changed records
+// are synced concurrently, by as many workers as the indexer used for other
+// modes walks files with, subject to the usual throttles. Deleted records
+// that were also added somewhere else, and so map to the same key, are not
+// deleted. Like Prune nothing is deleted if there are more than MaxDeletes
+// of them, and if ctx is cancelled nothing is deleted at all.
+
+func (s *RemoteSync) SyncGitDiff(ctx context.Context, d *GitDiff) error {
+
+	s.options.Logger.Status("%d files changed and %d files deleted in %s between %s and %s", len(d.Changed), len(d.Deleted), d.Repo, d.Since, d.Until)
+
+	s.mu.Lock()
+	s.partial = true
+	s.mu.Unlock()
+
+	keep := make(map[string]bool)
+
+	// this is the same number of goroutines that the indexer (or rather
+	// the walk package it uses) uses to walk a directory tree
+
+	workers := runtime.GOMAXPROCS(0)
+
+	wg := new(go_sync.WaitGroup)
+	throttle := make(chan bool, workers)
+
+	var sync_err error
+	sync_mu := new(go_sync.Mutex)
+
+	cb := func(path string, body []byte) error {
+
+		sync_mu.Lock()
+		first_err := sync_err
+		sync_mu.Unlock()
+
+		if first_err != nil {
+			return first_err
+		}
+
+		abs_path := filepath.Join(d.Repo, path)
+
+		is_wof, err := uri.IsWOFFile(abs_path)
+
+		if err != nil {
+			return err
+		}
+
+		if !is_wof {
+			atomic.AddInt64(&s.counts.skipped, 1)
+			return nil
+		}
+
+		dest, err := wofRelPath(abs_path)
+
+		if err != nil {
+			return err
+		}
+
+		keep[dest] = true
+
+		wg.Add(1)
+		throttle <- true
+
+		go func() {
+
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+
+			err := s.syncPath(ctx, bytes.NewReader(body), abs_path)
+
+			if err != nil {
+
+				sync_mu.Lock()
+
+				if sync_err == nil {
+					sync_err = err
+				}
+
+				sync_mu.Unlock()
+			}
+		}()
+
+		return nil
+	}
+
+	err := gitBlobs(d.Repo, d.Until, d.Changed, cb)
+
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	if sync_err != nil {
+		return sync_err
+	}
+
+	keys := make([]string, 0)
+
+	for _, path := range d.Deleted {
+
+		abs_path := filepath.Join(d.Repo, path)
+
+		is_wof, err := uri.IsWOFFile(abs_path)
+
+		if err != nil {
+			return err
+		}
+
+		if !is_wof {
+			continue
+		}
+
+		dest, err := wofRelPath(abs_path)
+
+		if err != nil {
+			return err
+		}
+
+		if !keep[dest] {
+			keys = append(keys, dest)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		s.options.Logger.Warning("Sync was interrupted, so not deleting %d remote files", len(keys))
+		return nil
+	}
+
+	if s.options.MaxDeletes >= 0 && len(keys) > s.options.MaxDeletes {
+		return fmt.Errorf("Refusing to delete %d files, which is more than the maximum (%d) allowed", len(keys), s.options.MaxDeletes)
+	}
+
+	return s.deleteKeys(keys)
+}
+
+// gitBlobs reads each of paths, as of rev, from repo and passes its contents
+// to cb. Everything is read using a single git cat-file process.
+
+func gitBlobs(repo string, rev string, paths []string, cb func(string, []byte) error) error {
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("git", "-C", repo, "cat-file", "--batch")
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+
+		wr := bufio.NewWriter(stdin)
+
+		for _, path := range paths {
+			fmt.Fprintf(wr, "%s:%s\n", rev, path)
+		}
+
+		wr.Flush()
+		stdin.Close()
+	}()
+
+	read := func() error {
+
+		reader := bufio.NewReader(stdout)
+
+		for _, path := range paths {
+
+			// {SHA} blob {SIZE}\n{CONTENTS}\n or {OBJECT} missing\n
+
+			hdr, err := reader.ReadString('\n')
+
+			if err != nil {
+				return err
+			}
+
+			fields := strings.Fields(hdr)
+
+			if len(fields) != 3 || fields[1] != "blob" {
+				return fmt.Errorf("Failed to read %s from git: %s", path, strings.TrimSpace(hdr))
+			}
+
+			size, err := strconv.Atoi(fields[2])
+
+			if err != nil {
+				return err
+			}
+
+			body := make([]byte, size+1)
+
+			_, err = io.ReadFull(reader, body)
+
+			if err != nil {
+				return err
+			}
+
+			err = cb(path, body[:size])
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = read()
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	err = cmd.Wait()
+
+	if err != nil {
+		return fmt.Errorf("git cat-file failed because %s (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// git runs the git command with args in repo, returning its output.
+
+func git(repo string, args ...string) ([]byte, error) {
+
+	args = append([]string{"-C", repo}, args...)
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed because %s (%s)", strings.Join(args[2:], " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,113 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func runGit(t *testing.T, repo string, args ...string) {
+
+	args = append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+
+	out, err := exec.Command("git", args...).CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("git %v failed because %s (%s)", args, err, out)
+	}
+}
+
+func TestRemoteSyncGitDiff(t *testing.T) {
+
+	_, err := exec.LookPath("git")
+
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	runGit(t, root, "init", "-q")
+	runGit(t, root, "add", "-A")
+	runGit(t, root, "commit", "-q", "-m", "first")
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{}), root)
+
+	changed_path, _ := uri.Id2RelPath(101736545)
+	deleted_path, _ := uri.Id2RelPath(1)
+	added_path, _ := uri.Id2RelPath(404404404)
+
+	changed := testFeature(101736545, "Montréal")
+	added := testFeature(404404404, "Added")
+
+	writeTestFile(t, filepath.Join(root, "data", changed_path), changed)
+	writeTestFile(t, filepath.Join(root, "data", added_path), added)
+
+	err = os.Remove(filepath.Join(root, "data", deleted_path))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runGit(t, root, "add", "-A")
+	runGit(t, root, "commit", "-q", "-m", "second")
+
+	// records are read from git, not the working tree
+
+	writeTestFile(t, filepath.Join(root, "data", changed_path), []byte("uncommitted"))
+
+	d, err := NewGitDiff(root, "HEAD~1", "HEAD")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Changed) != 2 || len(d.Deleted) != 1 {
+		t.Fatalf("Unexpected diff: %+v", d)
+	}
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{Prune: true, MaxDeletes: -1})
+
+	err = rs.SyncGitDiff(context.Background(), d)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rel_path, body := range map[string][]byte{changed_path: changed, added_path: added} {
+
+		obj := srv.Object(testBucket, filepath.Join("data", rel_path))
+
+		if obj == nil || !bytes.Equal(obj.Body, body) {
+			t.Fatalf("Expected %s to be synced", rel_path)
+		}
+	}
+
+	if srv.Object(testBucket, filepath.Join("data", deleted_path)) != nil {
+		t.Fatalf("Expected %s to be deleted", deleted_path)
+	}
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Unexpected keys: %v", srv.Keys(testBucket))
+	}
+
+	counts := rs.Report().Counts
+
+	if counts.Checked != 2 || counts.Uploaded != 2 || counts.Deleted != 1 {
+		t.Fatalf("Unexpected report counts: %+v", counts)
+	}
+	// only some records were seen so pruning would delete everything else
+
+	if rs.Prune() == nil {
+		t.Fatal("Expected prune to fail after a partial sync")
+	}
+}
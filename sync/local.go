@@ -0,0 +1,430 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-index"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-s3/throttle"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+type LocalSyncOptions struct {
+	Region      string
+	Bucket      string
+	Prefix      string
+	Credentials string
+	DSN         string
+	TargetURI   string
+	Target      Target
+	Root        string
+	Encryption  *EncryptionOptions
+	RateLimit   int
+	Force       bool
+	Dryrun      bool
+	Verbose     bool
+	Logger      *log.WOFLogger
+}
+
+// LocalSync copies WOF records from a (remote) Target in to a local data
+// directory, which is to say it is the remote -> local counterpart to RemoteSync.
+
+type LocalSync struct {
+	Sync
+	target   Target
+	options  LocalSyncOptions
+	throttle throttle.Throttle
+	detector *ChangeDetector
+}
+
+func NewLocalSync(opts LocalSyncOptions) (*LocalSync, error) {
+
+	if opts.Root == "" {
+		return nil, errors.New("Missing local root")
+	}
+
+	abs_root, err := filepath.Abs(opts.Root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Root = abs_root
+
+	t := opts.Target
+
+	if t == nil {
+
+		dsn := opts.DSN
+
+		if dsn == "" {
+			dsn = fmt.Sprintf("bucket=%s prefix=%s region=%s credentials=%s", opts.Bucket, opts.Prefix, opts.Region, opts.Credentials)
+		}
+
+		new_t, err := newTargetWithURIOrDSN(opts.TargetURI, dsn, opts.Encryption)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t = new_t
+	}
+
+	th, err := throttle.NewThrottledThrottle(opts.RateLimit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	part_size := int64(0)
+
+	ps, ok := t.(partSizer)
+
+	if ok {
+		part_size = ps.PartSize()
+	}
+
+	ls := LocalSync{
+		options:  opts,
+		target:   t,
+		throttle: th,
+		detector: NewChangeDetector(part_size),
+	}
+
+	ls.detector.OpaqueETags = hasOpaqueETags(t)
+
+	return &ls, nil
+}
+
+// SyncFunc returns an index.IndexerFunc that refreshes local WOF files from
+// their remote counterparts. Use SyncRemote to fetch everything in a bucket.
+
+func (s *LocalSync) SyncFunc() (index.IndexerFunc, error) {
+
+	f := func(fh io.Reader, ctx context.Context, args ...interface{}) error {
+
+		select {
+
+		case <-ctx.Done():
+			return nil
+		default:
+			// pass
+		}
+
+		path, err := index.PathForContext(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if path == index.STDIN {
+			return errors.New("Can't sync STDIN")
+		}
+
+		is_wof, err := uri.IsWOFFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		if !is_wof {
+			return nil
+		}
+
+		key, err := wofRelPath(path)
+
+		if err != nil {
+			return err
+		}
+
+		err = s.throttle.RateLimit()
+
+		if err != nil {
+			return err
+		}
+
+		if !s.options.Force {
+
+			obj, err := s.target.Head(key)
+
+			if err != nil {
+
+				if IsNotFound(err) {
+					s.options.Logger.Status("%s does not exist remotely, skipping", key)
+					return nil
+				}
+
+				return err
+			}
+
+			changed, err := s.hasChanged(obj)
+
+			if err != nil {
+				return err
+			}
+
+			if !changed {
+				return nil
+			}
+
+			return s.fetch(key, obj)
+		}
+
+		return s.fetch(key, nil)
+	}
+
+	return f, nil
+}
+
+// SyncFile writes fh to the local path for source, where source is the
+// (unprefixed) key of a WOF record in the remote bucket.
+
+func (s *LocalSync) SyncFile(fh io.Reader, source string) error {
+
+	local_path, err := s.localPath(source)
+
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(fh)
+
+	if err != nil {
+		return err
+	}
+
+	if !s.options.Force {
+
+		obj := TargetObject{
+			Key:  source,
+			ETag: MD5Hex(body),
+			Metadata: map[string]string{
+				MetadataSHA256: SHA256Hex(body),
+			},
+		}
+
+		changed, err := s.hasChanged(&obj)
+
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			return nil
+		}
+	}
+
+	s.options.Logger.Status("WRITE '%s'", local_path)
+
+	if s.options.Dryrun {
+		s.options.Logger.Status("Running in dryrun mode, so not writing anything...")
+		return nil
+	}
+
+	// write to a temporary file first so that an interrupted sync
+	// never leaves a partial record in the data tree
+
+	return writeFileAtomic(local_path, bytes.NewReader(body))
+}
+
+// SyncRemote lists every object in the target and copies any WOF
+// record that is missing or different locally in to the local root.
+
+func (s *LocalSync) SyncRemote() error {
+
+	failed := int64(0)
+
+	sync_obj := func(obj *TargetObject) error {
+
+		if !s.options.Force {
+
+			changed, err := s.hasChanged(obj)
+
+			if err != nil {
+				return err
+			}
+
+			if !changed {
+				return nil
+			}
+		}
+
+		err := s.throttle.RateLimit()
+
+		if err != nil {
+			return err
+		}
+
+		// listings don't include the Content-Encoding of objects so
+		// let fetch HEAD them before deciding how to decompress them
+
+		return s.fetch(obj.Key, nil)
+	}
+
+	cb := func(obj *TargetObject) error {
+
+		is_wof, err := uri.IsWOFFile(obj.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if !is_wof {
+			return nil
+		}
+
+		// log failures but keep going; they are reported below
+
+		err = sync_obj(obj)
+
+		if err != nil {
+			s.options.Logger.Error("Failed to sync %s because %s", obj.Key, err)
+			atomic.AddInt64(&failed, 1)
+		}
+
+		return nil
+	}
+
+	err := s.target.List(cb, "")
+
+	if err != nil {
+		return err
+	}
+
+	count_failed := atomic.LoadInt64(&failed)
+
+	if count_failed > 0 {
+		return fmt.Errorf("Failed to sync %d files", count_failed)
+	}
+
+	return nil
+}
+
+// fetch downloads key, decompresses it according to its Content-Encoding and
+// passes it to SyncFile. obj is the result of HEAD-ing key; if it is nil key
+// is HEAD-ed first and, unless syncing is forced, skipped if it hasn't changed
+// (which it always appears to have done in a listing if it was compressed).
+
+func (s *LocalSync) fetch(key string, obj *TargetObject) error {
+
+	if obj == nil {
+
+		head, err := s.target.Head(key)
+
+		if err != nil {
+			return err
+		}
+
+		if !s.options.Force && head.ContentEncoding != "" {
+
+			changed, err := s.hasChanged(head)
+
+			if err != nil {
+				return err
+			}
+
+			if !changed {
+				return nil
+			}
+		}
+
+		obj = head
+	}
+
+	s.options.Logger.Status("GET '%s'", key)
+
+	fh, err := s.target.Get(key)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	body, err := ioutil.ReadAll(fh)
+
+	if err != nil {
+		return err
+	}
+
+	body, err = decompress(body, obj.ContentEncoding)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decompress %s because %s", key, err)
+	}
+
+	return s.SyncFile(bytes.NewReader(body), key)
+}
+
+// hasChanged compares the local file for obj with obj, using the ChangeDetector.
+// Local files are never compressed so the local file is compressed the same
+// way as obj, if at all, before it is compared.
+
+func (s *LocalSync) hasChanged(obj *TargetObject) (bool, error) {
+
+	local_path, err := s.localPath(obj.Key)
+
+	if err != nil {
+		return false, err
+	}
+
+	body, err := ioutil.ReadFile(local_path)
+
+	if err != nil {
+
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	d := *s.detector
+	d.Encoding = obj.ContentEncoding
+
+	changed := d.HasChanged(body, obj)
+
+	s.options.Logger.Status("Has %s changed: %t", obj.Key, changed)
+	return changed, nil
+}
+
+func (s *LocalSync) localPath(key string) (string, error) {
+
+	rel_path, err := wofRelPath(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.options.Root, rel_path), nil
+}
+
+// wofRelPath maps any path (or key) for a WOF record on to its canonical
+// relative path, preserving the filename so that alternate geometries work.
+
+func wofRelPath(path string) (string, error) {
+
+	id, err := uri.IdFromPath(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	rel_path, err := uri.Id2RelPath(id)
+
+	if err != nil {
+		return "", err
+	}
+
+	root := filepath.Dir(rel_path)
+	fname := filepath.Base(path)
+
+	return filepath.Join(root, fname), nil
+}
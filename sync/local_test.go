@@ -0,0 +1,193 @@
+package sync
+
+import (
+	"bytes"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalSync(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	_, files := testRepo(t)
+
+	for rel_path, body := range files {
+		srv.PutObject(testBucket, filepath.Join("data", rel_path), body)
+	}
+
+	srv.PutObject(testBucket, "data/README.md", []byte("# data"))
+
+	root, err := ioutil.TempDir("", "pull")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	opts := LocalSyncOptions{
+		DSN:       srv.DSN(testBucket, "data"),
+		Root:      root,
+		RateLimit: 100000,
+		Logger:    testLogger(),
+	}
+
+	ls, err := NewLocalSync(opts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ls.SyncRemote()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rel_path, body := range files {
+
+		local, err := ioutil.ReadFile(filepath.Join(root, rel_path))
+
+		if err != nil {
+			t.Fatalf("Failed to read %s, %s", rel_path, err)
+		}
+
+		if !bytes.Equal(local, body) {
+			t.Fatalf("Unexpected body for %s", rel_path)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(root, "README.md"))
+
+	if !os.IsNotExist(err) {
+		t.Fatal("Non-WOF file was synced")
+	}
+
+	// everything is the same now so nothing should be fetched
+
+	gets := srv.Requests("GET")
+
+	err = ls.SyncRemote()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only GET is the listing itself
+
+	if srv.Requests("GET") != gets+1 {
+		t.Fatalf("Expected 1 new GET but got %d", srv.Requests("GET")-gets)
+	}
+}
+
+func TestLocalSyncCompressed(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	repo, files := testRepo(t)
+	defer os.RemoveAll(repo)
+
+	for _, encoding := range []string{CompressGzip, CompressBrotli} {
+
+		mem_t, err := NewMemoryTarget()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{Compress: encoding}), repo)
+
+		rs, err := NewRemoteSync(RemoteSyncOptions{Target: mem_t, RateLimit: 100000, Compress: encoding, Logger: testLogger()})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		indexRepo(t, rs, repo)
+
+		targets := map[string]LocalSyncOptions{
+			"s3":  {DSN: srv.DSN(testBucket, "data")},
+			"mem": {Target: mem_t},
+		}
+
+		for label, opts := range targets {
+
+			root, err := ioutil.TempDir("", "pull")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer os.RemoveAll(root)
+
+			opts.Root = filepath.Join(root, "data")
+			opts.RateLimit = 100000
+			opts.Logger = testLogger()
+
+			ls, err := NewLocalSync(opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ls.SyncRemote()
+
+			if err != nil {
+				t.Fatalf("Failed to pull %s records from %s, %s", encoding, label, err)
+			}
+
+			// records are written uncompressed, and then made to look old
+			// so that rewriting them (which they shouldn't be) is obvious
+
+			old := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+
+			for rel_path, body := range files {
+
+				local_path := filepath.Join(opts.Root, rel_path)
+				local, err := ioutil.ReadFile(local_path)
+
+				if err != nil {
+					t.Fatalf("Failed to read %s, %s", rel_path, err)
+				}
+
+				if !bytes.Equal(local, body) {
+					t.Fatalf("Unexpected body for %s pulled from %s with %s", rel_path, label, encoding)
+				}
+
+				err = os.Chtimes(local_path, old, old)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = ls.SyncRemote()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			indexRepo(t, ls, root)
+
+			for rel_path := range files {
+
+				info, err := os.Stat(filepath.Join(opts.Root, rel_path))
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !info.ModTime().Equal(old) {
+					t.Fatalf("%s was pulled from %s again with %s even though it hasn't changed", rel_path, label, encoding)
+				}
+			}
+		}
+	}
+}
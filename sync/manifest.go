@@ -0,0 +1,340 @@
+package sync
+
+// A Manifest is a record of what has been synced to a Target, keyed by the
+// (target relative) key of each object. It exists so that RemoteSync can
+// decide whether a file has changed without having to issue a HEAD request
+// for every single file. Manifests are serialized as JSON-lines, one entry
+// per line, sorted by key.
+//
+// A manifest is only as good as the last sync that wrote it: if objects are
+// changed or removed by something else then the manifest should be rebuilt
+// from a listing of the target.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	go_sync "sync"
+	"time"
+)
+
+type ManifestEntry struct {
+	Key        string    `json:"key"`
+	ETag       string    `json:"etag"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Encoding   string    `json:"content_encoding,omitempty"`
+	Encryption string    `json:"encryption,omitempty"`
+	Size       int64     `json:"size"`
+	LastSynced time.Time `json:"last_synced"`
+}
+
+type Manifest struct {
+	entries map[string]*ManifestEntry
+	mu      *go_sync.RWMutex
+}
+
+func NewManifest() *Manifest {
+
+	m := Manifest{
+		entries: make(map[string]*ManifestEntry),
+		mu:      new(go_sync.RWMutex),
+	}
+
+	return &m
+}
+
+// ReadManifest parses a JSON-lines manifest from fh.
+
+func ReadManifest(fh io.Reader) (*Manifest, error) {
+
+	m := NewManifest()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+
+		ln := bytes.TrimSpace(scanner.Bytes())
+
+		if len(ln) == 0 {
+			continue
+		}
+
+		var e ManifestEntry
+
+		err := json.Unmarshal(ln, &e)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.Set(&e)
+	}
+
+	err := scanner.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ReadManifestFile reads the manifest stored at path. If path does not exist
+// an empty manifest is returned.
+
+func ReadManifestFile(path string) (*Manifest, error) {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+
+		if os.IsNotExist(err) {
+			return NewManifest(), nil
+		}
+
+		return nil, err
+	}
+
+	defer fh.Close()
+
+	return ReadManifest(fh)
+}
+
+// ReadManifestFromTarget reads the manifest stored as key in t. If key does
+// not exist an empty manifest is returned.
+
+func ReadManifestFromTarget(t Target, key string) (*Manifest, error) {
+
+	fh, err := t.Get(key)
+
+	if err != nil {
+
+		if IsNotFound(err) {
+			return NewManifest(), nil
+		}
+
+		return nil, err
+	}
+
+	defer fh.Close()
+
+	return ReadManifest(fh)
+}
+
+// NewManifestFromTarget builds a new manifest by listing everything in t,
+// except for ignore (which is typically the key of the manifest itself).
+
+func NewManifestFromTarget(t Target, ignore string) (*Manifest, error) {
+	return NewManifestFromTargetWithShards(t, ignore, "")
+}
+
+// NewManifestFromTargetWithShards builds a new manifest by listing everything
+// in t whose key starts with one of shards, except for ignore. Each shard is
+// listed in parallel.
+
+func NewManifestFromTargetWithShards(t Target, ignore string, shards ...string) (*Manifest, error) {
+
+	m := NewManifest()
+	now := time.Now()
+
+	cb := func(obj *TargetObject) error {
+
+		if obj.Key == ignore {
+			return nil
+		}
+
+		e := ManifestEntry{
+			Key:        obj.Key,
+			ETag:       obj.ETag,
+			Size:       obj.Size,
+			LastSynced: now,
+		}
+
+		m.Set(&e)
+		return nil
+	}
+
+	err_ch := make(chan error, len(shards))
+	wg := new(go_sync.WaitGroup)
+
+	for _, shard := range shards {
+
+		wg.Add(1)
+
+		go func(shard string) {
+
+			defer wg.Done()
+
+			err := t.List(cb, shard)
+
+			if err != nil {
+				err_ch <- fmt.Errorf("Failed to list '%s' because %s", shard, err)
+			}
+
+		}(shard)
+	}
+
+	wg.Wait()
+	close(err_ch)
+
+	// the first error, if there was one
+
+	err := <-err_ch
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Object returns e as a TargetObject, suitable for passing to a ChangeDetector.
+
+func (e *ManifestEntry) Object() *TargetObject {
+
+	obj := TargetObject{
+		Key:             e.Key,
+		Size:            e.Size,
+		ETag:            e.ETag,
+		LastModified:    e.LastSynced,
+		ContentEncoding: e.Encoding,
+		Encryption:      e.Encryption,
+		Metadata:        make(map[string]string),
+	}
+
+	if e.SHA256 != "" {
+		obj.Metadata[MetadataSHA256] = e.SHA256
+	}
+
+	return &obj
+}
+
+func (m *Manifest) Get(key string) (*ManifestEntry, bool) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+func (m *Manifest) Set(e *ManifestEntry) {
+
+	m.mu.Lock()
+	m.entries[e.Key] = e
+	m.mu.Unlock()
+}
+
+func (m *Manifest) Remove(key string) {
+
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+}
+
+func (m *Manifest) Len() int {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.entries)
+}
+
+// Each invokes cb for every entry in the manifest, sorted by key, as though
+// it were a TargetObject.
+
+func (m *Manifest) Each(cb TargetListCallback) error {
+
+	for _, e := range m.sorted() {
+
+		err := cb(e.Object())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write writes the manifest to fh as JSON-lines, sorted by key.
+
+func (m *Manifest) Write(fh io.Writer) error {
+
+	wr := bufio.NewWriter(fh)
+	enc := json.NewEncoder(wr)
+
+	for _, e := range m.sorted() {
+
+		err := enc.Encode(e)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return wr.Flush()
+}
+
+// WriteFile (atomically) writes the manifest to path.
+
+func (m *Manifest) WriteFile(path string) error {
+
+	var buf bytes.Buffer
+
+	err := m.Write(&buf)
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, &buf)
+}
+
+// WriteToTarget writes the manifest to t as key.
+
+func (m *Manifest) WriteToTarget(t Target, key string, opts *PutOptions) error {
+
+	var buf bytes.Buffer
+
+	err := m.Write(&buf)
+
+	if err != nil {
+		return err
+	}
+
+	put_opts := PutOptions{}
+
+	if opts != nil {
+		put_opts = *opts
+	}
+
+	put_opts.ContentType = "application/x-ndjson"
+
+	return t.Put(key, ioutil.NopCloser(&buf), &put_opts)
+}
+
+func (m *Manifest) sorted() []*ManifestEntry {
+
+	m.mu.RLock()
+
+	entries := make([]*ManifestEntry, 0, len(m.entries))
+
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+
+	m.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
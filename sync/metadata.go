@@ -0,0 +1,78 @@
+package sync
+
+// Metadata that is attached to WOF records when they are uploaded so that
+// consumers can filter and verify objects with a HEAD request rather than
+// having to download and parse them. In S3 these are stored as x-amz-meta-*
+// headers, for example x-amz-meta-wof-placetype.
+
+import (
+	"encoding/json"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"strconv"
+)
+
+const (
+	MetadataWOFId           = "wof-id"
+	MetadataWOFPlacetype    = "wof-placetype"
+	MetadataWOFLastModified = "wof-lastmodified"
+	MetadataWOFRepo         = "wof-repo"
+	MetadataWOFAlt          = "wof-alt"      // "true" or "false"
+	MetadataWOFAltGeom      = "wof-alt-geom" // for example "quattroshapes", only set for alternate geometries
+)
+
+type wofProperties struct {
+	Properties struct {
+		Placetype    string      `json:"wof:placetype"`
+		LastModified json.Number `json:"wof:lastmodified"`
+		Repo         string      `json:"wof:repo"`
+	} `json:"properties"`
+}
+
+// WOFMetadata returns the metadata for the WOF record at path whose contents
+// are body. This does not include the SHA-256 hash of body.
+
+func WOFMetadata(path string, body []byte) (map[string]string, error) {
+
+	id, err := uri.IdFromPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	alt, err := uri.AltGeomFromPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var props wofProperties
+
+	err = json.Unmarshal(body, &props)
+
+	if err != nil {
+		return nil, err
+	}
+
+	md := map[string]string{
+		MetadataWOFId:  strconv.FormatInt(id, 10),
+		MetadataWOFAlt: strconv.FormatBool(alt != nil),
+	}
+
+	if alt != nil {
+		md[MetadataWOFAltGeom] = alt.String()
+	}
+
+	if props.Properties.Placetype != "" {
+		md[MetadataWOFPlacetype] = props.Properties.Placetype
+	}
+
+	if props.Properties.LastModified != "" {
+		md[MetadataWOFLastModified] = props.Properties.LastModified.String()
+	}
+
+	if props.Properties.Repo != "" {
+		md[MetadataWOFRepo] = props.Properties.Repo
+	}
+
+	return md, nil
+}
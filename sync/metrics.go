@@ -0,0 +1,115 @@
+package sync
+
+// Metrics are the Prometheus metrics that RemoteSync updates as it runs, for
+// monitoring long running syncs. They are created in (and served by) a
+// metrics.Registry; a nil *Metrics means that nothing is recorded.
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/whosonfirst/go-whosonfirst-s3/metrics"
+	"net"
+	"time"
+)
+
+type Metrics struct {
+	Requests     *metrics.CounterVec // by method: HEAD, PUT or DELETE
+	HeadSeconds  *metrics.Histogram
+	PutSeconds   *metrics.Histogram
+	Bytes        *metrics.Counter
+	ThrottleWait *metrics.Histogram
+	Errors       *metrics.CounterVec // by (AWS) error code
+	InFlight     *metrics.Gauge
+}
+
+func NewMetrics(r *metrics.Registry) *Metrics {
+
+	m := Metrics{
+		Requests:     r.NewCounterVec("wof_s3_sync_requests_total", "The number of requests made to the target.", "method"),
+		HeadSeconds:  r.NewHistogram("wof_s3_sync_head_seconds", "The time it took to HEAD remote objects.", nil),
+		PutSeconds:   r.NewHistogram("wof_s3_sync_put_seconds", "The time it took to PUT remote objects.", nil),
+		Bytes:        r.NewCounter("wof_s3_sync_uploaded_bytes_total", "The number of (possibly compressed) bytes uploaded."),
+		ThrottleWait: r.NewHistogram("wof_s3_sync_throttle_wait_seconds", "The time spent waiting for the rate limiter.", nil),
+		Errors:       r.NewCounterVec("wof_s3_sync_errors_total", "The number of failed requests, by error code.", "code"),
+		InFlight:     r.NewGauge("wof_s3_sync_uploads_in_flight", "The number of uploads in progress."),
+	}
+
+	return &m
+}
+
+// observeRequest records a request using method, that started at t1 and
+// failed with err (if it isn't nil). Objects that don't exist aren't errors.
+
+func (m *Metrics) observeRequest(method string, t1 time.Time, err error) {
+
+	if m == nil {
+		return
+	}
+
+	d := time.Since(t1).Seconds()
+
+	m.Requests.Inc(method)
+
+	switch method {
+	case "HEAD":
+		m.HeadSeconds.Observe(d)
+	case "PUT":
+		m.PutSeconds.Observe(d)
+	}
+
+	if err != nil && !IsNotFound(err) {
+		m.Errors.Inc(errorCode(err))
+	}
+}
+
+func (m *Metrics) observeThrottle(d time.Duration) {
+
+	if m == nil {
+		return
+	}
+
+	m.ThrottleWait.Observe(d.Seconds())
+}
+
+func (m *Metrics) startUpload() {
+
+	if m == nil {
+		return
+	}
+
+	m.InFlight.Inc()
+}
+
+func (m *Metrics) finishUpload(size int, err error) {
+
+	if m == nil {
+		return
+	}
+
+	m.InFlight.Dec()
+
+	if err == nil {
+		m.Bytes.Add(float64(size))
+	}
+}
+
+// errorCode returns the AWS error code for err, "Timeout" for network
+// timeouts or "Unknown" for anything else.
+
+func errorCode(err error) string {
+
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		return "Timeout"
+	}
+
+	aws_err, ok := err.(awserr.Error)
+
+	if !ok {
+		return "Unknown"
+	}
+
+	if aws_err.Code() == "MultipartUpload" && aws_err.OrigErr() != nil {
+		return errorCode(aws_err.OrigErr())
+	}
+
+	return aws_err.Code()
+}
@@ -5,77 +5,327 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/whosonfirst/go-whosonfirst-aws/s3"
 	"github.com/whosonfirst/go-whosonfirst-index"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-s3/throttle"
 	"github.com/whosonfirst/go-whosonfirst-uri"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
+	go_sync "sync"
+	"sync/atomic"
+	"time"
 )
 
 type RemoteSyncOptions struct {
-	Region      string
-	Bucket      string
-	Prefix      string
-	Credentials string
-	DSN         string
-	ACL         string
-	RateLimit   int
-	Force       bool
-	Dryrun      bool
-	Verbose     bool
-	Logger      *log.WOFLogger
+	Region             string
+	Bucket             string
+	Prefix             string
+	Credentials        string
+	DSN                string
+	TargetURI          string
+	Target             Target
+	ACL                string
+	RateLimit          int               // the maximum number of files synced (or deleted) per minute; 0 means no limit
+	MaxInFlight        int               // the maximum number of concurrent uploads; 0 means no limit
+	RequestsPerSec     int               // the maximum number of requests (HEAD, PUT or DELETE) per second; 0 means no limit
+	BytesPerSec        int64             // the maximum number of bytes uploaded per second; 0 means no limit
+	Throttle           throttle.Throttle // if set, used instead of RequestsPerSec to throttle requests
+	MaxAttempts        int
+	Backoff            time.Duration
+	Prune              bool
+	MaxDeletes         int
+	Manifest           string // the path to a local manifest file
+	ManifestKey        string // the key for a manifest stored in the target
+	RebuildManifest    bool
+	Checkpoint         string        // the path to a checkpoint file
+	CheckpointCommit   string        // the git commit being synced, if known
+	CheckpointInterval time.Duration // if 0 DefaultCheckpointInterval is used
+	Prefetch           bool
+	PartSize           int64  // if 0 the target's part size, or the aws-sdk-go default, is used
+	Compress           string // see ValidCompressions
+	Encryption         *EncryptionOptions
+	Rules              *Rules
+	Metrics            *Metrics // if nil no metrics are recorded
+	Force              bool
+	Dryrun             bool
+	Verbose            bool
+	Logger             *log.WOFLogger
 }
 
 type RemoteSync struct {
 	Sync
-	config   *s3.S3Config
-	conn     *s3.S3Connection
-	options  RemoteSyncOptions
-	throttle throttle.Throttle
+	target     Target
+	options    RemoteSyncOptions
+	throttle   throttle.Throttle
+	requests   throttle.Throttle
+	bandwidth  *throttle.TokenBucket
+	inflight   chan bool
+	retries    *retryQueue
+	failures   []*Failure
+	cancelled  []string
+	seen       map[string]bool
+	partial    bool // true if only some local files were synced, for example by SyncGitDiff or because indexing failed, so Prune is unsafe
+	manifest   *Manifest
+	remote     *Manifest
+	checkpoint *Checkpoint
+	detector   *ChangeDetector
+	counts     *syncCounts
+	started    time.Time
+	mu         *go_sync.Mutex
 }
 
-func NewRemoteSync(opts RemoteSyncOptions) (Sync, error) {
+// prefetchShards are the prefixes that the target is listed by, in parallel,
+// when Prefetch is enabled. WOF records are stored in directories named for
+// the first three digits of their ID so this covers everything.
 
-	dsn := opts.DSN
+var prefetchShards = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
 
-	if dsn == "" {
-		dsn = fmt.Sprintf("bucket=%s prefix=%s region=%s credentials=%s", opts.Bucket, opts.Prefix, opts.Region, opts.Credentials)
+// ErrCancelled is returned by the function that SyncFuncWithContext returns
+// once its context has been cancelled, so that indexers stop walking files.
+
+var ErrCancelled = errors.New("Sync was cancelled")
+
+func NewRemoteSync(opts RemoteSyncOptions) (*RemoteSync, error) {
+
+	t := opts.Target
+
+	if t == nil {
+
+		dsn := opts.DSN
+
+		if dsn == "" {
+			dsn = fmt.Sprintf("bucket=%s prefix=%s region=%s credentials=%s", opts.Bucket, opts.Prefix, opts.Region, opts.Credentials)
+		}
+
+		new_t, err := newTargetWithURIOrDSN(opts.TargetURI, dsn, opts.Encryption)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t = new_t
 	}
 
-	cfg, err := s3.NewS3ConfigFromString(dsn)
+	th, err := throttle.NewThrottledThrottle(opts.RateLimit)
 
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := s3.NewS3Connection(cfg)
+	err = ensureCompression(opts.Compress)
 
 	if err != nil {
 		return nil, err
 	}
 
-	th, err := throttle.NewThrottledThrottle(opts.RateLimit)
+	// files don't have a Content-Encoding so there would be no way to
+	// know that (or how) to decompress them when they are pulled
 
-	if err != nil {
-		return nil, err
+	_, is_fs := t.(*FSTarget)
+
+	if opts.Compress != "" && is_fs {
+		return nil, errors.New("Compression is not supported by file:// targets, which can't record a Content-Encoding")
+	}
+
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+
+	part_size := opts.PartSize
+
+	if part_size == 0 {
+
+		ps, ok := t.(partSizer)
+
+		if ok {
+			part_size = ps.PartSize()
+		}
 	}
 
 	rs := RemoteSync{
-		options:  opts,
-		config:   cfg,
-		conn:     conn,
-		throttle: th,
+		options:   opts,
+		target:    t,
+		throttle:  th,
+		retries:   newRetryQueue(),
+		failures:  make([]*Failure, 0),
+		cancelled: make([]string, 0),
+		seen:      make(map[string]bool),
+		detector:  NewChangeDetector(part_size),
+		counts:    new(syncCounts),
+		started:   time.Now(),
+		mu:        new(go_sync.Mutex),
+	}
+
+	rs.detector.Encoding = opts.Compress
+	rs.detector.OpaqueETags = hasOpaqueETags(t)
+
+	if opts.MaxInFlight > 0 {
+		rs.inflight = make(chan bool, opts.MaxInFlight)
+	}
+
+	if opts.Throttle != nil {
+
+		rs.requests = opts.Throttle
+
+	} else if opts.RequestsPerSec > 0 {
+
+		requests, err := throttle.NewRequestsThrottle(opts.RequestsPerSec)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rs.requests = requests
+	}
+
+	if opts.BytesPerSec > 0 {
+
+		// allow up to a second's worth of bytes in a single burst
+
+		bandwidth, err := throttle.NewTokenBucket(float64(opts.BytesPerSec), float64(opts.BytesPerSec))
+
+		if err != nil {
+			return nil, err
+		}
+
+		rs.bandwidth = bandwidth
+	}
+
+	if opts.Manifest != "" || opts.ManifestKey != "" {
+
+		m, err := rs.loadManifest()
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Logger.Status("Manifest has %d entries", m.Len())
+		rs.manifest = m
+
+	} else if opts.RebuildManifest {
+		return nil, errors.New("Rebuilding a manifest requires a manifest path or key")
+	}
+
+	if opts.Checkpoint != "" {
+
+		if opts.Dryrun {
+
+			opts.Logger.Status("Running in dryrun mode, so not using checkpoint...")
+
+		} else {
+
+			cp, err := OpenCheckpoint(opts.Checkpoint, opts.CheckpointCommit, opts.CheckpointInterval, opts.Force)
+
+			if err != nil {
+				return nil, err
+			}
+
+			opts.Logger.Status("Checkpoint has %d synced files", cp.Len())
+			rs.checkpoint = cp
+		}
+	}
+
+	if opts.Prefetch {
+
+		t1 := time.Now()
+
+		remote, err := NewManifestFromTargetWithShards(t, opts.ManifestKey, prefetchShards...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Logger.Status("Prefetched %d remote objects in %v", remote.Len(), time.Since(t1))
+		rs.remote = remote
 	}
 
 	return &rs, nil
 }
 
+// loadManifest reads the manifest from the local manifest file, if it exists,
+// or the target otherwise. If RebuildManifest is set the manifest is instead
+// built from scratch by listing everything in the target.
+
+func (s *RemoteSync) loadManifest() (*Manifest, error) {
+
+	if s.options.RebuildManifest {
+		s.options.Logger.Status("Rebuilding manifest from %s", s.target.URI(""))
+		return NewManifestFromTarget(s.target, s.options.ManifestKey)
+	}
+
+	if s.options.Manifest != "" {
+
+		_, err := os.Stat(s.options.Manifest)
+
+		if err == nil || s.options.ManifestKey == "" {
+			return ReadManifestFile(s.options.Manifest)
+		}
+	}
+
+	return ReadManifestFromTarget(s.target, s.options.ManifestKey)
+}
+
+// SaveManifest writes the manifest, if there is one, to the local manifest
+// file and/or the target.
+
+func (s *RemoteSync) SaveManifest() error {
+
+	if s.manifest == nil {
+		return nil
+	}
+
+	if s.options.Dryrun {
+		s.options.Logger.Status("Running in dryrun mode, so not saving manifest...")
+		return nil
+	}
+
+	if s.options.Manifest != "" {
+
+		err := s.manifest.WriteFile(s.options.Manifest)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.options.ManifestKey != "" {
+
+		put_opts := PutOptions{
+			ACL: s.options.ACL,
+		}
+
+		err := s.manifest.WriteToTarget(s.target, s.options.ManifestKey, &put_opts)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	s.options.Logger.Status("Saved manifest with %d entries", s.manifest.Len())
+	return nil
+}
+
 func (s *RemoteSync) SyncFunc() (index.IndexerFunc, error) {
+	return s.SyncFuncWithContext(context.Background())
+}
 
-	f := func(fh io.Reader, ctx context.Context, args ...interface{}) error {
+// SyncFuncWithContext returns an index.IndexerFunc that syncs files until
+// sync_ctx is cancelled. Once it is, files that are still waiting to be
+// synced (for example because they are being throttled) give up immediately,
+// and are recorded so that they can be written out with WriteUnsynced, and
+// every file after that returns ErrCancelled which stops the indexer from
+// walking (and opening) any more files. Uploads that have already started
+// are allowed to finish. Files that were never reached are not recorded
+// anywhere; use a Checkpoint (or a Manifest) to resume a cancelled sync. Any
+// other error, which also stops the indexer, means that not every local file
+// was seen so Prune will refuse to run.
+
+func (s *RemoteSync) SyncFuncWithContext(sync_ctx context.Context) (index.IndexerFunc, error) {
+
+	sync_f := func(fh io.Reader, ctx context.Context, args ...interface{}) error {
 
 		select {
 
@@ -85,6 +335,10 @@ func (s *RemoteSync) SyncFunc() (index.IndexerFunc, error) {
 			// pass
 		}
 
+		if sync_ctx.Err() != nil {
+			return ErrCancelled
+		}
+
 		path, err := index.PathForContext(ctx)
 
 		if err != nil {
@@ -102,28 +356,670 @@ func (s *RemoteSync) SyncFunc() (index.IndexerFunc, error) {
 		}
 
 		if !is_wof {
+			atomic.AddInt64(&s.counts.skipped, 1)
 			return nil
 		}
 
-		err = s.throttle.RateLimit()
+		return s.syncPath(sync_ctx, fh, path)
+	}
+
+	f := func(fh io.Reader, ctx context.Context, args ...interface{}) error {
+
+		err := sync_f(fh, ctx, args...)
+
+		if err != nil && err != ErrCancelled {
+			s.mu.Lock()
+			s.partial = true
+			s.mu.Unlock()
+		}
+
+		return err
+	}
+
+	return f, nil
+}
+
+// syncPath syncs the WOF record at path, reading its contents from fh, unless
+// ctx has been cancelled or the checkpoint says it has already been synced.
+// Errors syncing the record are handled (and possibly retried) rather than
+// returned.
+
+func (s *RemoteSync) syncPath(ctx context.Context, fh io.Reader, path string) error {
+
+	if ctx.Err() != nil {
+		s.cancel(path)
+		return nil
+	}
+
+	if s.isCheckpointed(path) {
+		atomic.AddInt64(&s.counts.checkpointed, 1)
+		return nil
+	}
+
+	atomic.AddInt64(&s.counts.checked, 1)
+
+	err := s.rateLimit(ctx)
+
+	if err != nil {
+
+		if ctx.Err() != nil {
+			s.cancel(path)
+			return nil
+		}
+
+		return err
+	}
+
+	// read the body now so that it can be retried if necessary
+
+	body, err := ioutil.ReadAll(fh)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.syncFile(ctx, bytes.NewReader(body), path)
+
+	if err != nil {
+
+		if ctx.Err() != nil {
+			s.cancel(path)
+			return nil
+		}
+
+		s.handleError(path, body, 1, err)
+		return nil
+	}
+
+	s.confirm(path)
+	return nil
+}
+
+// Retry (re) syncs any files that failed with a retryable error, waiting
+// an exponentially increasing amount of time between each round of attempts.
+// Files that still fail after MaxAttempts are recorded as failures.
+
+func (s *RemoteSync) Retry() error {
+	return s.RetryWithContext(context.Background())
+}
+
+// RetryWithContext is the same as Retry except that it stops as soon as ctx
+// is cancelled, recording any files that haven't been retried yet so that
+// they can be written out with WriteUnsynced.
+
+func (s *RemoteSync) RetryWithContext(ctx context.Context) error {
+
+	backoff := s.options.Backoff
+
+	for {
+
+		items := s.retries.Drain()
+
+		if len(items) == 0 {
+			break
+		}
+
+		s.options.Logger.Status("Retrying %d files in %v", len(items), backoff)
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+			// pass
+		}
+
+		for _, item := range items {
+
+			if ctx.Err() != nil {
+				s.cancel(item.path)
+				continue
+			}
+
+			err := s.rateLimit(ctx)
+
+			if err != nil {
+
+				if ctx.Err() != nil {
+					s.cancel(item.path)
+					continue
+				}
+
+				return err
+			}
+
+			item.attempts += 1
+
+			err = s.syncFile(ctx, bytes.NewReader(item.body), item.path)
+
+			if err != nil {
+
+				if ctx.Err() != nil {
+					s.cancel(item.path)
+					continue
+				}
+
+				s.handleError(item.path, item.body, item.attempts, err)
+				continue
+			}
+
+			s.confirm(item.path)
+		}
+
+		backoff = backoff * 2
+	}
+
+	return nil
+}
+
+// Failures returns the list of files that could not be synced.
+
+func (s *RemoteSync) Failures() []*Failure {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := make([]*Failure, len(s.failures))
+	copy(failures, s.failures)
+
+	return failures
+}
+
+// WriteFailures writes the paths of any files that could not be synced to
+// path, one per line, so that they can be fed back in to a later sync using
+// the "filelist" indexer mode.
+
+func (s *RemoteSync) WriteFailures(path string) error {
+
+	fh, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range s.Failures() {
+
+		_, err := fmt.Fprintln(fh, f.Path)
 
 		if err != nil {
+			fh.Close()
 			return err
 		}
+	}
+
+	return fh.Close()
+}
+
+// Report returns a Report with the counts, failures and effective options for
+// the sync so far. Its start time is when the sync was created. Callers are
+// expected to add the timings for each path they index and call Finish.
+
+func (s *RemoteSync) Report() *Report {
+
+	failures := make([]*ReportError, 0)
+
+	for _, f := range s.Failures() {
+
+		e := ReportError{
+			Path:     f.Path,
+			Attempts: f.Attempts,
+			Error:    f.Error.Error(),
+		}
 
-		err = s.SyncFile(fh, path)
+		failures = append(failures, &e)
+	}
+
+	counts := s.counts.snapshot()
+	counts.Failed = int64(len(failures))
+	counts.Cancelled = int64(len(s.Cancelled()))
+
+	encryption := ""
+
+	et, ok := s.target.(encryptedTarget)
+
+	if ok {
+		encryption = et.Encryption()
+	}
+
+	opts := ReportOptions{
+		Target:          s.target.URI(""),
+		ACL:             s.options.ACL,
+		RateLimit:       s.options.RateLimit,
+		MaxInFlight:     s.options.MaxInFlight,
+		RequestsPerSec:  s.options.RequestsPerSec,
+		BytesPerSec:     s.options.BytesPerSec,
+		MaxAttempts:     s.options.MaxAttempts,
+		Backoff:         s.options.Backoff.String(),
+		Prune:           s.options.Prune,
+		MaxDeletes:      s.options.MaxDeletes,
+		Manifest:        s.options.Manifest,
+		ManifestKey:     s.options.ManifestKey,
+		Checkpoint:      s.options.Checkpoint,
+		RebuildManifest: s.options.RebuildManifest,
+		Prefetch:        s.options.Prefetch,
+		PartSize:        s.detector.PartSize,
+		Compress:        s.options.Compress,
+		Encryption:      encryption,
+		Rules:           s.options.Rules != nil,
+		Force:           s.options.Force,
+		Dryrun:          s.options.Dryrun,
+	}
+
+	r := Report{
+		Started:  s.started,
+		Counts:   counts,
+		Paths:    make([]*ReportPath, 0),
+		Failures: failures,
+		Errors:   make([]string, 0),
+		Options:  opts,
+	}
+
+	return &r
+}
+
+// isCheckpointed reports whether the checkpoint, if there is one, says that
+// path has already been synced. If it does path is still marked as seen, for
+// the purposes of pruning.
+
+func (s *RemoteSync) isCheckpointed(path string) bool {
+
+	if s.checkpoint == nil || !s.checkpoint.Has(path) {
+		return false
+	}
+
+	dest, err := wofRelPath(path)
+
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	s.seen[dest] = true
+	s.mu.Unlock()
+
+	return true
+}
+
+// confirm records that path has been synced in the checkpoint, if there is
+// one. Failing to update a checkpoint is not a reason to stop syncing.
+
+func (s *RemoteSync) confirm(path string) {
+
+	if s.checkpoint == nil {
+		return
+	}
+
+	err := s.checkpoint.Add(path)
+
+	if err != nil {
+		s.options.Logger.Warning("Failed to update checkpoint for %s because %s", path, err)
+	}
+}
+
+// CloseCheckpoint writes any outstanding paths to the checkpoint file, if
+// there is one, and closes it. Once a sync has completed successfully there
+// is nothing left to resume so remove should be true, which deletes it.
+
+func (s *RemoteSync) CloseCheckpoint(remove bool) error {
+
+	if s.checkpoint == nil {
+		return nil
+	}
+
+	return s.checkpoint.Close(remove)
+}
+
+// cancel records that path was not synced because the sync was cancelled.
+
+func (s *RemoteSync) cancel(path string) {
+
+	s.mu.Lock()
+	s.cancelled = append(s.cancelled, path)
+	s.mu.Unlock()
+}
+
+// Cancelled returns the list of files that were not synced because the sync
+// was cancelled.
+
+func (s *RemoteSync) Cancelled() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cancelled := make([]string, len(s.cancelled))
+	copy(cancelled, s.cancelled)
+
+	return cancelled
+}
+
+// WriteUnsynced writes the paths of every file that was not synced, because
+// the sync was cancelled while it was in progress, it failed or it is still
+// waiting to be retried, to path, one per line. Files that the sync never
+// reached, because it was cancelled first, are not included. Like
+// WriteFailures it can be fed back in to a later sync using the "filelist"
+// indexer mode.
+
+func (s *RemoteSync) WriteUnsynced(path string) error {
+
+	paths := s.Cancelled()
+
+	for _, f := range s.Failures() {
+		paths = append(paths, f.Path)
+	}
+
+	for _, item := range s.retries.Items() {
+		paths = append(paths, item.path)
+	}
+
+	sort.Strings(paths)
+
+	fh, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+
+		_, err := fmt.Fprintln(fh, p)
 
 		if err != nil {
+			fh.Close()
 			return err
 		}
+	}
+
+	return fh.Close()
+}
+
+// Prune deletes any WOF records in the remote bucket (and prefix) that were
+// not seen by SyncFile, which is to say records that have been removed or
+// moved locally. It should only be called once indexing of every local
+// record has completed successfully, and refuses to do anything after a
+// partial sync (like SyncGitDiff). Only records at their canonical location,
+// {ID PATH}/{FILENAME} relative to the target, are considered so copies of
+// records elsewhere in the target are never deleted. Prune will refuse to
+// delete anything if the number of orphaned records exceeds MaxDeletes (a
+// negative value disables this check).
+
+func (s *RemoteSync) Prune() error {
+
+	if !s.options.Prune {
+		return errors.New("Pruning is not enabled")
+	}
+
+	s.mu.Lock()
+	count_seen := len(s.seen)
+	partial := s.partial
+	s.mu.Unlock()
+
+	if partial {
+		return errors.New("Only some local files were synced, refusing to prune")
+	}
+
+	if count_seen == 0 {
+		return errors.New("No files have been synced, refusing to prune everything")
+	}
+
+	orphans := make([]string, 0)
+	orphans_mu := new(go_sync.Mutex)
+
+	cb := func(obj *TargetObject) error {
+
+		is_wof, err := uri.IsWOFFile(obj.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if !is_wof {
+			return nil
+		}
+
+		// for example quarantine/115/932/484/9/1159324849.geojson
+
+		canonical, err := wofRelPath(obj.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if canonical != obj.Key {
+			return nil
+		}
+
+		s.mu.Lock()
+		_, ok := s.seen[obj.Key]
+		s.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		orphans_mu.Lock()
+		orphans = append(orphans, obj.Key)
+		orphans_mu.Unlock()
 
 		return nil
 	}
 
-	return f, nil
+	// if the remote state was prefetched there's no need to list everything
+	// again; anything uploaded since then will have been seen anyway
+
+	var err error
+
+	if s.remote != nil {
+		err = s.remote.Each(cb)
+	} else {
+		err = s.target.List(cb, "")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	count_orphans := len(orphans)
+
+	s.options.Logger.Status("Found %d remote files that no longer exist locally", count_orphans)
+
+	if s.options.MaxDeletes >= 0 && count_orphans > s.options.MaxDeletes {
+		return fmt.Errorf("Refusing to delete %d files, which is more than the maximum (%d) allowed", count_orphans, s.options.MaxDeletes)
+	}
+
+	return s.deleteKeys(orphans)
+}
+
+// deleteKeys deletes keys from the target, and the manifest if there is one,
+// carrying on if any of them fail. Keys that don't exist aren't failures.
+
+func (s *RemoteSync) deleteKeys(keys []string) error {
+
+	failed := 0
+
+	for _, key := range keys {
+
+		s.options.Logger.Status("DELETE '%s'", key)
+
+		if s.options.Dryrun {
+			atomic.AddInt64(&s.counts.would_delete, 1)
+			continue
+		}
+
+		err := s.rateLimit(context.Background())
+
+		if err != nil {
+			return err
+		}
+
+		err = s.waitForRequest(context.Background())
+
+		if err != nil {
+			return err
+		}
+
+		t1 := time.Now()
+
+		err = s.target.Delete(key)
+		s.observeRequest("DELETE", t1, err)
+
+		if err != nil && !IsNotFound(err) {
+			s.options.Logger.Error("Failed to delete %s because %s", key, err)
+			failed += 1
+			continue
+		}
+
+		atomic.AddInt64(&s.counts.deleted, 1)
+
+		if s.manifest != nil {
+			s.manifest.Remove(key)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to delete %d files", failed)
+	}
+
+	return nil
+}
+
+// rateLimit waits for the throttle, recording how long that took.
+
+func (s *RemoteSync) rateLimit(ctx context.Context) error {
+
+	t1 := time.Now()
+	err := s.throttle.RateLimitContext(ctx)
+
+	s.options.Metrics.observeThrottle(time.Since(t1))
+	return err
+}
+
+// observeRequest records the outcome of a request to the target, that was
+// made using method and started at t1, and tells the throttles about it so
+// that they can adjust their limits if necessary.
+
+func (s *RemoteSync) observeRequest(method string, t1 time.Time, err error) {
+
+	s.options.Metrics.observeRequest(method, t1, err)
+
+	// objects that don't exist aren't errors as far as throttling goes
+
+	if IsNotFound(err) {
+		err = nil
+	}
+
+	s.throttle.Report(err)
+
+	if s.requests != nil {
+		s.requests.Report(err)
+	}
+}
+
+// waitForRequest waits until the requests per second limit, if there is one,
+// allows another request to the target.
+
+func (s *RemoteSync) waitForRequest(ctx context.Context) error {
+
+	if s.requests == nil {
+		return ctx.Err()
+	}
+
+	t1 := time.Now()
+	err := s.requests.RateLimitContext(ctx)
+
+	s.options.Metrics.observeThrottle(time.Since(t1))
+	return err
+}
+
+// startUpload waits until there are fewer than MaxInFlight uploads in
+// progress and the requests and bandwidth limits allow size more bytes to be
+// uploaded. Every call to startUpload that returns without an error must be
+// followed by a call to finishUpload.
+
+func (s *RemoteSync) startUpload(ctx context.Context, size int) error {
+
+	if s.inflight != nil || s.bandwidth != nil {
+
+		t1 := time.Now()
+
+		if s.inflight != nil {
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case s.inflight <- true:
+				// pass
+			}
+		}
+
+		if s.bandwidth != nil {
+
+			err := s.bandwidth.WaitContext(ctx, float64(size))
+
+			if err != nil {
+				s.finishUpload()
+				return err
+			}
+		}
+
+		s.options.Metrics.observeThrottle(time.Since(t1))
+	}
+
+	err := s.waitForRequest(ctx)
+
+	if err != nil {
+		s.finishUpload()
+		return err
+	}
+
+	return nil
+}
+
+func (s *RemoteSync) finishUpload() {
+
+	if s.inflight != nil {
+		<-s.inflight
+	}
+}
+
+func (s *RemoteSync) handleError(path string, body []byte, attempts int, err error) {
+
+	if IsRetryableError(err) && attempts < s.options.MaxAttempts {
+
+		s.options.Logger.Warning("Failed to sync %s (attempt %d), will retry because %s", path, attempts, err)
+
+		item := retryItem{
+			path:     path,
+			body:     body,
+			attempts: attempts,
+		}
+
+		s.retries.Push(&item)
+		atomic.AddInt64(&s.counts.retried, 1)
+		return
+	}
+
+	s.options.Logger.Error("Failed to sync %s (attempt %d) because %s", path, attempts, err)
+
+	f := Failure{
+		Path:     path,
+		Attempts: attempts,
+		Error:    err,
+	}
+
+	s.mu.Lock()
+	s.failures = append(s.failures, &f)
+	s.mu.Unlock()
 }
 
 func (s *RemoteSync) SyncFile(fh io.Reader, source string) error {
+	return s.syncFile(context.Background(), fh, source)
+}
+
+// syncFile syncs source, giving up if ctx is cancelled before its upload has
+// started.
+
+func (s *RemoteSync) syncFile(ctx context.Context, fh io.Reader, source string) error {
 
 	id, err := uri.IdFromPath(source)
 
@@ -141,20 +1037,24 @@ func (s *RemoteSync) SyncFile(fh io.Reader, source string) error {
 	fname := filepath.Base(source)
 	dest := filepath.Join(root, fname)
 
-	key := fmt.Sprintf("%s#ACL=%s", dest, s.options.ACL)
-	prepped_key := s.conn.PrepareKey(dest)
+	// keep track of everything we've seen, whether or not it is actually
+	// uploaded, for the purposes of pruning remote files
 
-	s.options.Logger.Debug("CHECK %d (%s) AS '%s' AS '%s'", id, rel_path, key, prepped_key)
+	s.mu.Lock()
+	s.seen[dest] = true
+	s.mu.Unlock()
 
-	if !s.options.Force {
+	s.options.Logger.Debug("CHECK %d (%s) AS '%s'", id, rel_path, s.target.URI(dest))
 
-		body, err := ioutil.ReadAll(fh)
+	body, err := ioutil.ReadAll(fh)
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return err
+	}
 
-		changed, err := s.conn.HasChanged(dest, body)
+	if !s.options.Force {
+
+		changed, err := s.hasChanged(ctx, dest, body)
 
 		if err != nil {
 			return err
@@ -163,35 +1063,169 @@ func (s *RemoteSync) SyncFile(fh io.Reader, source string) error {
 		s.options.Logger.Status("Has %s changed: %t", dest, changed)
 
 		if !changed {
+			atomic.AddInt64(&s.counts.unchanged, 1)
 			return nil
 		}
-
-		fh = bytes.NewReader(body)
 	}
 
-	s.options.Logger.Status("PUT '%s'", key)
+	s.options.Logger.Status("PUT '%s'", dest)
 
 	if s.options.Dryrun {
 		s.options.Logger.Status("Running in dryrun mode, so not PUT-ing anything...")
+		atomic.AddInt64(&s.counts.would_upload, 1)
 		return nil
 	}
 
-	closer := ioutil.NopCloser(fh)
+	local_sha := SHA256Hex(body)
+
+	// a record that can't be parsed is still uploaded, just without the
+	// WOF specific metadata
 
-	err = s.conn.Put(key, closer)
+	md, err := WOFMetadata(source, body)
 
-	// s3/utils.IsAWSErrorWithCode
+	if err != nil {
+		s.options.Logger.Warning("Failed to derive WOF metadata for %s because %s", source, err)
+		md = make(map[string]string)
+	}
+
+	md[MetadataSHA256] = local_sha
+
+	put_opts := PutOptions{
+		ACL:      s.options.ACL,
+		Metadata: md,
+	}
+
+	if s.options.Rules != nil {
+		s.options.Rules.Apply(dest, &put_opts)
+	}
+
+	// the content type is still derived from the (uncompressed) key so
+	// a compressed .geojson file is still application/vnd.geo+json
+
+	if s.options.Compress != "" {
+
+		compressed, err := compress(body, s.options.Compress)
 
-	/*
 		if err != nil {
+			return err
+		}
 
-			aws_err := err.(awserr.Error)
+		body = compressed
+		put_opts.ContentEncoding = s.options.Compress
+	}
 
-			if aws_err.Code() == "SlowDown" {
+	closer := ioutil.NopCloser(bytes.NewReader(body))
 
-			}
+	// errors are classified (and possibly retried) by SyncFunc and Retry
+
+	err = s.startUpload(ctx, len(body))
+
+	if err != nil {
+		return err
+	}
+
+	t1 := time.Now()
+	s.options.Metrics.startUpload()
+
+	err = s.target.Put(dest, closer, &put_opts)
+
+	s.finishUpload()
+	s.options.Metrics.finishUpload(len(body), err)
+	s.observeRequest("PUT", t1, err)
+
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.counts.uploaded, 1)
+	atomic.AddInt64(&s.counts.bytes, int64(len(body)))
+
+	if s.manifest != nil {
+
+		e := ManifestEntry{
+			Key:        dest,
+			ETag:       MD5Hex(body),
+			SHA256:     local_sha,
+			Encoding:   s.options.Compress,
+			Size:       int64(len(body)),
+			LastSynced: time.Now(),
 		}
-	*/
 
-	return err
+		s.manifest.Set(&e)
+	}
+
+	return nil
+}
+
+// hasChanged compares body (the contents of a local file) with the remote
+// object for key, using the ChangeDetector. If the remote state was prefetched
+// then that is considered authoritative. Otherwise if there is a manifest
+// entry for key then that is used instead of asking the target. Objects that
+// don't exist remotely have always changed.
+
+func (s *RemoteSync) hasChanged(ctx context.Context, key string, body []byte) (bool, error) {
+
+	if s.remote != nil {
+
+		e, ok := s.remote.Get(key)
+
+		if !ok {
+			return true, nil
+		}
+
+		// for example because the object is encrypted with SSE-KMS and
+		// listings don't include metadata; fall back to a HEAD request
+
+		if s.detector.CanCompare(e.Object()) {
+			return s.detector.HasChanged(body, e.Object()), nil
+		}
+	}
+
+	if s.manifest != nil {
+
+		e, ok := s.manifest.Get(key)
+
+		if ok && s.detector.CanCompare(e.Object()) {
+			return s.detector.HasChanged(body, e.Object()), nil
+		}
+	}
+
+	err := s.waitForRequest(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	t1 := time.Now()
+
+	obj, err := s.target.Head(key)
+	s.observeRequest("HEAD", t1, err)
+
+	if err != nil {
+
+		if IsNotFound(err) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	// remember what the target told us for next time
+
+	if s.manifest != nil {
+
+		e := ManifestEntry{
+			Key:        key,
+			ETag:       obj.ETag,
+			SHA256:     obj.Metadata[MetadataSHA256],
+			Encoding:   obj.ContentEncoding,
+			Encryption: obj.Encryption,
+			Size:       obj.Size,
+			LastSynced: time.Now(),
+		}
+
+		s.manifest.Set(&e)
+	}
+
+	return s.detector.HasChanged(body, obj), nil
 }
@@ -0,0 +1,1110 @@
+package sync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/common/expfmt"
+	"github.com/whosonfirst/go-whosonfirst-index"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"github.com/whosonfirst/go-whosonfirst-s3/metrics"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteSync(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{})
+	indexRepo(t, rs, root)
+
+	keys := srv.Keys(testBucket)
+
+	if len(keys) != len(files) {
+		t.Fatalf("Expected %d keys but got %d: %v", len(files), len(keys), keys)
+	}
+
+	for rel_path, body := range files {
+
+		obj := srv.Object(testBucket, filepath.Join("data", rel_path))
+
+		if obj == nil {
+			t.Fatalf("Missing remote object for %s", rel_path)
+		}
+
+		if !bytes.Equal(obj.Body, body) {
+			t.Fatalf("Unexpected body for %s", rel_path)
+		}
+
+		if obj.ACL != "public-read" {
+			t.Fatalf("Unexpected ACL for %s: '%s'", rel_path, obj.ACL)
+		}
+
+		if obj.Metadata[MetadataSHA256] != SHA256Hex(body) {
+			t.Fatalf("Unexpected SHA-256 metadata for %s: '%s'", rel_path, obj.Metadata[MetadataSHA256])
+		}
+
+		if obj.Metadata[MetadataWOFPlacetype] != "locality" || obj.Metadata[MetadataWOFRepo] != "whosonfirst-data" || obj.Metadata[MetadataWOFLastModified] != "1562180580" {
+			t.Fatalf("Unexpected WOF metadata for %s: %v", rel_path, obj.Metadata)
+		}
+
+		is_alt := strings.Contains(rel_path, "-alt-")
+
+		if obj.Metadata[MetadataWOFAlt] != strconv.FormatBool(is_alt) {
+			t.Fatalf("Unexpected %s metadata for %s: %v", MetadataWOFAlt, rel_path, obj.Metadata)
+		}
+
+		if is_alt && obj.Metadata[MetadataWOFAltGeom] != "quattroshapes" {
+			t.Fatalf("Unexpected %s metadata for %s: %v", MetadataWOFAltGeom, rel_path, obj.Metadata)
+		}
+	}
+
+	if len(rs.Failures()) != 0 {
+		t.Fatalf("Unexpected failures: %v", rs.Failures())
+	}
+}
+
+func TestRemoteSyncUnchanged(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{}), root)
+
+	puts := srv.Requests("PUT")
+
+	if puts != len(files) {
+		t.Fatalf("Expected %d PUTs but got %d", len(files), puts)
+	}
+
+	// nothing has changed so nothing should be uploaded
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{}), root)
+
+	if srv.Requests("PUT") != puts {
+		t.Fatalf("Expected no new PUTs but got %d", srv.Requests("PUT")-puts)
+	}
+
+	// unless we ask
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{Force: true}), root)
+
+	if srv.Requests("PUT") != puts*2 {
+		t.Fatalf("Expected %d new PUTs but got %d", puts, srv.Requests("PUT")-puts)
+	}
+}
+
+func TestRemoteSyncRetry(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	// enough failures to get past the retries in aws-sdk-go itself (which
+	// backs off for much longer for SlowDown errors, hence InternalError)
+
+	srv.Fail("PUT", "InternalError", 500, 4*len(files))
+
+	opts := RemoteSyncOptions{
+		MaxAttempts: 10,
+		Backoff:     10 * time.Millisecond,
+	}
+
+	rs := testRemoteSync(t, srv, opts)
+	indexRepo(t, rs, root)
+
+	if len(srv.Keys(testBucket)) == len(files) {
+		t.Fatal("Expected some files to be queued for retrying")
+	}
+
+	err := rs.Retry()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs.Failures()) != 0 {
+		t.Fatalf("Unexpected failures: %v", rs.Failures())
+	}
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %d", len(files), len(srv.Keys(testBucket)))
+	}
+}
+
+func TestRemoteSyncFailures(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	// AccessDenied is not retryable
+
+	srv.Fail("PUT", "AccessDenied", 403, 1)
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{MaxAttempts: 5})
+	indexRepo(t, rs, root)
+
+	err := rs.Retry()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := rs.Failures()
+
+	if len(failures) != 1 {
+		t.Fatalf("Expected 1 failure but got %d", len(failures))
+	}
+
+	if failures[0].Attempts != 1 {
+		t.Fatalf("Expected failure after 1 attempt but got %d", failures[0].Attempts)
+	}
+
+	fh, err := ioutil.TempFile("", "failures")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh.Close()
+	defer os.Remove(fh.Name())
+
+	err = rs.WriteFailures(fh.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(fh.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(body)) != failures[0].Path {
+		t.Fatalf("Unexpected failures file: %s", body)
+	}
+
+	if len(srv.Keys(testBucket)) != len(files)-1 {
+		t.Fatalf("Expected %d keys but got %d", len(files)-1, len(srv.Keys(testBucket)))
+	}
+}
+
+func TestRemoteSyncPrune(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	orphan := "data/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, orphan, testFeature(404404404, "Orphan"))
+
+	other := "data/README.md"
+	srv.PutObject(testBucket, other, []byte("# data"))
+
+	// a WOF record that isn't at its canonical location, like a copy
+	// quarantined by wof-s3-delete, is not an orphan
+
+	quarantined := "data/quarantine/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, quarantined, testFeature(404404404, "Orphan"))
+
+	// first check that the safety cap works
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{Prune: true, MaxDeletes: 0})
+	indexRepo(t, rs, root)
+
+	err := rs.Prune()
+
+	if err == nil {
+		t.Fatal("Expected prune to fail because of MaxDeletes")
+	}
+
+	if srv.Object(testBucket, orphan) == nil {
+		t.Fatal("Orphan was deleted despite MaxDeletes")
+	}
+
+	rs = testRemoteSync(t, srv, RemoteSyncOptions{Prune: true, MaxDeletes: 10})
+	indexRepo(t, rs, root)
+
+	err = rs.Prune()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.Object(testBucket, orphan) != nil {
+		t.Fatal("Orphan was not deleted")
+	}
+
+	if srv.Object(testBucket, other) == nil {
+		t.Fatal("Non-WOF file was deleted")
+	}
+
+	if srv.Object(testBucket, quarantined) == nil {
+		t.Fatal("Non-canonical WOF file was deleted")
+	}
+
+	if len(srv.Keys(testBucket)) != len(files)+2 {
+		t.Fatalf("Expected %d keys but got %d", len(files)+2, len(srv.Keys(testBucket)))
+	}
+}
+
+func TestRemoteSyncPruneIndexError(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, _ := testRepo(t)
+	defer os.RemoveAll(root)
+
+	orphan := "data/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, orphan, testFeature(404404404, "Orphan"))
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{Prune: true, MaxDeletes: 10})
+	indexRepo(t, rs, root)
+
+	cb, err := rs.SyncFunc()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a context without a path, which the indexer would never pass
+
+	err = cb(strings.NewReader(""), context.Background())
+
+	if err == nil {
+		t.Fatal("Expected sync func to fail without a path")
+	}
+
+	err = rs.Prune()
+
+	if err == nil {
+		t.Fatal("Expected prune to fail after an indexing error")
+	}
+
+	if srv.Object(testBucket, orphan) == nil {
+		t.Fatal("Orphan was deleted after an indexing error")
+	}
+}
+
+func TestRemoteSyncDryrun(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	orphan := "data/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, orphan, testFeature(404404404, "Orphan"))
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{Prune: true, MaxDeletes: 10, Dryrun: true})
+	indexRepo(t, rs, root)
+
+	err := rs.Prune()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.Keys(testBucket)) != 1 {
+		t.Fatalf("Expected nothing to change but got %v", srv.Keys(testBucket))
+	}
+
+	counts := rs.Report().Counts
+
+	if counts.WouldUpload != int64(len(files)) || counts.WouldDelete != 1 || counts.Uploaded != 0 || counts.Deleted != 0 {
+		t.Fatalf("Unexpected report counts: %+v", counts)
+	}
+}
+
+func TestRemoteSyncManifest(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	manifest := filepath.Join(root, "manifest.jsonl")
+
+	opts := RemoteSyncOptions{
+		Manifest:    manifest,
+		ManifestKey: "manifest.jsonl",
+	}
+
+	rs := testRemoteSync(t, srv, opts)
+	indexRepo(t, rs, root)
+
+	err := rs.SaveManifest()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.Object(testBucket, "data/manifest.jsonl") == nil {
+		t.Fatal("Missing remote manifest")
+	}
+
+	m, err := ReadManifestFile(manifest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Len() != len(files) {
+		t.Fatalf("Expected %d manifest entries but got %d", len(files), m.Len())
+	}
+
+	// nothing has changed and everything is in the manifest so there
+	// shouldn't be any HEAD requests (or PUTs)
+
+	heads := srv.Requests("HEAD")
+	puts := srv.Requests("PUT")
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	if srv.Requests("HEAD") != heads {
+		t.Fatalf("Expected no new HEADs but got %d", srv.Requests("HEAD")-heads)
+	}
+
+	if srv.Requests("PUT") != puts {
+		t.Fatalf("Expected no new PUTs but got %d", srv.Requests("PUT")-puts)
+	}
+
+	// the same should be true when only the remote manifest is available
+
+	os.Remove(manifest)
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	if srv.Requests("HEAD") != heads {
+		t.Fatalf("Expected no new HEADs but got %d", srv.Requests("HEAD")-heads)
+	}
+}
+
+func TestRemoteSyncRebuildManifest(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{}), root)
+
+	// a stale remote manifest
+
+	srv.PutObject(testBucket, "data/manifest.jsonl", []byte(`{"key":"101/736/545/101736545.geojson","etag":"stale","size":0}`))
+
+	opts := RemoteSyncOptions{
+		ManifestKey:     "manifest.jsonl",
+		RebuildManifest: true,
+	}
+
+	rs := testRemoteSync(t, srv, opts)
+
+	err := rs.SaveManifest()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadManifest(bytes.NewReader(srv.Object(testBucket, "data/manifest.jsonl").Body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Len() != len(files) {
+		t.Fatalf("Expected %d manifest entries but got %d", len(files), m.Len())
+	}
+
+	e, ok := m.Get("101/736/545/101736545.geojson")
+
+	if !ok || e.ETag == "stale" {
+		t.Fatalf("Unexpected manifest entry: %v", e)
+	}
+}
+
+func TestRemoteSyncPrefetch(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{}), root)
+
+	orphan := "data/404/404/404/404404404.geojson"
+	srv.PutObject(testBucket, orphan, testFeature(404404404, "Orphan"))
+
+	rel_path := "101/736/545/101736545.geojson"
+	writeTestFile(t, filepath.Join(root, "data", rel_path), testFeature(101736545, "Montréal"))
+
+	heads := srv.Requests("HEAD")
+	puts := srv.Requests("PUT")
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{Prefetch: true, Prune: true, MaxDeletes: 10})
+	indexRepo(t, rs, root)
+
+	if srv.Requests("HEAD") != heads {
+		t.Fatalf("Expected no new HEADs but got %d", srv.Requests("HEAD")-heads)
+	}
+
+	if srv.Requests("PUT") != puts+1 {
+		t.Fatalf("Expected 1 new PUT but got %d", srv.Requests("PUT")-puts)
+	}
+
+	err := rs.Prune()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.Object(testBucket, orphan) != nil {
+		t.Fatal("Orphan was not deleted")
+	}
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %d", len(files), len(srv.Keys(testBucket)))
+	}
+}
+
+func TestRemoteSyncCompress(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	opts := RemoteSyncOptions{
+		Compress: CompressGzip,
+	}
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	for rel_path, body := range files {
+
+		obj := srv.Object(testBucket, filepath.Join("data", rel_path))
+
+		if obj == nil {
+			t.Fatalf("Missing remote object for %s", rel_path)
+		}
+
+		if obj.ContentEncoding != "gzip" {
+			t.Fatalf("Unexpected content encoding for %s: '%s'", rel_path, obj.ContentEncoding)
+		}
+
+		if obj.ContentType != "application/vnd.geo+json" {
+			t.Fatalf("Unexpected content type for %s: '%s'", rel_path, obj.ContentType)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(obj.Body))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uncompressed, err := ioutil.ReadAll(gz)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(uncompressed, body) {
+			t.Fatalf("Unexpected (uncompressed) body for %s", rel_path)
+		}
+
+		if obj.Metadata[MetadataSHA256] != SHA256Hex(body) {
+			t.Fatalf("Unexpected SHA-256 metadata for %s", rel_path)
+		}
+	}
+
+	// nothing has changed, whether that is determined by HEAD-ing each
+	// file (and comparing SHA-256 hashes) or by listing everything (and
+	// comparing the ETags of compressed bodies)
+
+	puts := srv.Requests("PUT")
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	opts.Prefetch = true
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	if srv.Requests("PUT") != puts {
+		t.Fatalf("Expected no new PUTs but got %d", srv.Requests("PUT")-puts)
+	}
+
+	// but switching compression off means everything has changed
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{}), root)
+
+	if srv.Requests("PUT") != puts*2 {
+		t.Fatalf("Expected %d new PUTs but got %d", puts, srv.Requests("PUT")-puts)
+	}
+
+	for _, encoding := range []string{"zip", "deflate"} {
+
+		_, err := NewRemoteSync(RemoteSyncOptions{DSN: srv.DSN(testBucket, "data"), RateLimit: 100, Compress: encoding, Logger: testLogger()})
+
+		if err == nil {
+			t.Fatalf("Expected an error for an invalid compression '%s'", encoding)
+		}
+	}
+
+	_, err := NewRemoteSync(RemoteSyncOptions{TargetURI: "file:///tmp", RateLimit: 100, Compress: CompressGzip, Logger: testLogger()})
+
+	if err == nil {
+		t.Fatal("Expected an error for compression with a file:// target")
+	}
+}
+
+func TestRemoteSyncCompressBrotli(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	opts := RemoteSyncOptions{
+		Compress: CompressBrotli,
+	}
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	for rel_path, body := range files {
+
+		obj := srv.Object(testBucket, filepath.Join("data", rel_path))
+
+		if obj == nil {
+			t.Fatalf("Missing remote object for %s", rel_path)
+		}
+
+		if obj.ContentEncoding != "br" {
+			t.Fatalf("Unexpected content encoding for %s: '%s'", rel_path, obj.ContentEncoding)
+		}
+
+		uncompressed, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(obj.Body)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(uncompressed, body) {
+			t.Fatalf("Unexpected (uncompressed) body for %s", rel_path)
+		}
+	}
+
+	// Brotli is deterministic too so listing everything and comparing
+	// ETags finds nothing has changed
+
+	puts := srv.Requests("PUT")
+
+	opts.Prefetch = true
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	if srv.Requests("PUT") != puts {
+		t.Fatalf("Expected no new PUTs but got %d", srv.Requests("PUT")-puts)
+	}
+
+	// and switching to gzip means everything has changed
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{Compress: CompressGzip}), root)
+
+	if srv.Requests("PUT") != puts*2 {
+		t.Fatalf("Expected %d new PUTs but got %d", puts, srv.Requests("PUT")-puts)
+	}
+}
+
+func TestRemoteSyncRules(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, _ := testRepo(t)
+	defer os.RemoveAll(root)
+
+	str_rules := `[
+		{ "pattern": "*.geojson", "cache_control": "public, max-age=3600" },
+		{ "pattern": "*-alt-*.geojson", "cache_control": "public, max-age=86400", "storage_class": "STANDARD_IA", "tags": { "alt": "true" } },
+		{ "regexp": "^856/", "acl": "private", "content_disposition": "attachment" }
+	]`
+
+	rules, err := NewRules(strings.NewReader(str_rules))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{Rules: rules}), root)
+
+	primary := srv.Object(testBucket, "data/101/736/545/101736545.geojson")
+
+	if primary.CacheControl != "public, max-age=3600" || primary.StorageClass != "" || primary.Tagging != "" {
+		t.Fatalf("Unexpected settings for primary record: '%s' '%s' '%s'", primary.CacheControl, primary.StorageClass, primary.Tagging)
+	}
+
+	alt := srv.Object(testBucket, "data/101/736/545/101736545-alt-quattroshapes.geojson")
+
+	if alt.CacheControl != "public, max-age=86400" || alt.StorageClass != "STANDARD_IA" || alt.Tagging != "alt=true" {
+		t.Fatalf("Unexpected settings for alternate geometry: '%s' '%s' '%s'", alt.CacheControl, alt.StorageClass, alt.Tagging)
+	}
+
+	other := srv.Object(testBucket, "data/856/327/93/85632793.geojson")
+
+	if other.ACL != "private" || other.ContentDisposition != "attachment" || other.CacheControl != "public, max-age=3600" {
+		t.Fatalf("Unexpected settings for record: '%s' '%s' '%s'", other.ACL, other.ContentDisposition, other.CacheControl)
+	}
+
+	_, err = NewRules(strings.NewReader(`[ { "cache_control": "no-cache" } ]`))
+
+	if err == nil {
+		t.Fatal("Expected an error for a rule without a pattern")
+	}
+}
+
+func TestRemoteSyncEncryption(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	opts := RemoteSyncOptions{
+		Encryption: &EncryptionOptions{
+			SSE:      "aws:kms",
+			KMSKeyId: "alias/whosonfirst",
+		},
+	}
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	for rel_path, body := range files {
+
+		obj := srv.Object(testBucket, filepath.Join("data", rel_path))
+
+		if obj == nil {
+			t.Fatalf("Missing remote object for %s", rel_path)
+		}
+
+		if obj.SSE != "aws:kms" || obj.SSEKMSKeyId != "alias/whosonfirst" {
+			t.Fatalf("Unexpected encryption for %s: '%s' '%s'", rel_path, obj.SSE, obj.SSEKMSKeyId)
+		}
+
+		if strings.Trim(obj.ETag, "\"") == MD5Hex(body) {
+			t.Fatalf("Expected an opaque ETag for %s", rel_path)
+		}
+	}
+
+	// the ETags are useless but nothing has changed, whether that is
+	// determined by HEAD-ing each file or by listing everything (which
+	// falls back to HEAD-ing each file)
+
+	puts := srv.Requests("PUT")
+	heads := srv.Requests("HEAD")
+
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	opts.Prefetch = true
+	indexRepo(t, testRemoteSync(t, srv, opts), root)
+
+	if srv.Requests("PUT") != puts {
+		t.Fatalf("Expected no new PUTs but got %d", srv.Requests("PUT")-puts)
+	}
+
+	if srv.Requests("HEAD") != heads+2*len(files) {
+		t.Fatalf("Expected %d new HEADs but got %d", 2*len(files), srv.Requests("HEAD")-heads)
+	}
+
+	opts.Encryption = &EncryptionOptions{KMSKeyId: "alias/whosonfirst"}
+
+	_, err := NewRemoteSync(RemoteSyncOptions{DSN: srv.DSN(testBucket, "data"), RateLimit: 100, Encryption: opts.Encryption, Logger: testLogger()})
+
+	if err == nil {
+		t.Fatal("Expected an error for a KMS key without SSE-KMS")
+	}
+
+	for _, target := range []string{"mem://", "file:///tmp/whosonfirst-data"} {
+
+		_, err := NewRemoteSync(RemoteSyncOptions{TargetURI: target, RateLimit: 100, Encryption: &EncryptionOptions{SSE: "AES256"}, Logger: testLogger()})
+
+		if err == nil {
+			t.Fatalf("Expected an error for encryption with a %s target", target)
+		}
+	}
+}
+
+func TestRemoteSyncMetrics(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	srv.Fail("PUT", "AccessDenied", 403, 1)
+
+	r := metrics.NewRegistry()
+	m := NewMetrics(r)
+
+	indexRepo(t, testRemoteSync(t, srv, RemoteSyncOptions{Metrics: m}), root)
+
+	count := float64(len(files))
+
+	var buf bytes.Buffer
+
+	err := r.Write(&buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+
+	expected := []string{
+		fmt.Sprintf("wof_s3_sync_requests_total{method=\"HEAD\"} %v", count),
+		fmt.Sprintf("wof_s3_sync_requests_total{method=\"PUT\"} %v", count),
+		fmt.Sprintf("wof_s3_sync_head_seconds_count %v", count),
+		fmt.Sprintf("wof_s3_sync_throttle_wait_seconds_count %v", count),
+		"wof_s3_sync_errors_total{code=\"AccessDenied\"} 1",
+		"wof_s3_sync_uploads_in_flight 0",
+	}
+
+	for _, ln := range expected {
+
+		if !strings.Contains(out, ln+"\n") {
+			t.Fatalf("Missing '%s' in:\n%s", ln, out)
+		}
+	}
+
+	if m.Bytes.Value() == 0 {
+		t.Fatal("Expected some bytes to have been uploaded")
+	}
+
+	var parser expfmt.TextParser
+
+	_, err = parser.TextToMetricFamilies(strings.NewReader(out))
+
+	if err != nil {
+		t.Fatalf("Failed to parse metrics, %s\n%s", err, out)
+	}
+}
+
+func TestRemoteSyncLimits(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	total := 0
+
+	for _, body := range files {
+		total += len(body)
+	}
+
+	// a second's worth of bytes is (just) less than everything, so the
+	// last upload has to wait for about a quarter of a second
+
+	opts := RemoteSyncOptions{
+		MaxInFlight:    1,
+		RequestsPerSec: 1000,
+		BytesPerSec:    int64(float64(total) / 1.25),
+	}
+
+	t1 := time.Now()
+
+	rs := testRemoteSync(t, srv, opts)
+	indexRepo(t, rs, root)
+
+	d := time.Since(t1)
+
+	if d < 150*time.Millisecond {
+		t.Fatalf("Expected uploads to be throttled but they took %v", d)
+	}
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys but got %d", len(files), len(srv.Keys(testBucket)))
+	}
+
+	// a rate limit of 0 means no limit, rather than a divide by zero
+
+	_, err := NewRemoteSync(RemoteSyncOptions{DSN: srv.DSN(testBucket, "data"), Logger: testLogger()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteSyncCancel(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	// one request per second means that all but the first file are stuck
+	// waiting for the throttle when the sync is cancelled
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{RequestsPerSec: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	cb, err := rs.SyncFuncWithContext(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := index.NewIndexer("repo", cb)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1 := time.Now()
+
+	err = idx.IndexPath(root)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(t1) > 900*time.Millisecond {
+		t.Fatalf("Expected sync to stop when it was cancelled but it took %v", time.Since(t1))
+	}
+
+	cancelled := rs.Cancelled()
+
+	if len(cancelled) == 0 {
+		t.Fatal("Expected some files to be cancelled")
+	}
+
+	// files that hadn't been reached when the sync was cancelled are
+	// neither synced nor cancelled
+
+	if len(cancelled)+len(srv.Keys(testBucket)) > len(files) {
+		t.Fatalf("Expected at most %d files to be synced or cancelled but got %d cancelled and %d synced", len(files), len(cancelled), len(srv.Keys(testBucket)))
+	}
+
+	if len(rs.Failures()) != 0 {
+		t.Fatalf("Cancelled files should not be failures: %v", rs.Failures())
+	}
+
+	fh, err := ioutil.TempFile("", "unsynced")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh.Close()
+	defer os.Remove(fh.Name())
+
+	err = rs.WriteUnsynced(fh.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(fh.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(strings.Split(strings.TrimSpace(string(body)), "\n")) != len(cancelled) {
+		t.Fatalf("Unexpected unsynced file: %s", body)
+	}
+
+	if rs.Report().Counts.Cancelled != int64(len(cancelled)) {
+		t.Fatalf("Unexpected report counts: %+v", rs.Report().Counts)
+	}
+}
+
+func TestRemoteSyncCancelStopsWalking(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, err := ioutil.TempDir("", "whosonfirst-data")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	// everything is in a single directory, which is walked sequentially
+
+	total := 200
+
+	for i := 1; i <= total; i++ {
+		writeTestFile(t, filepath.Join(root, "data", fmt.Sprintf("%d.geojson", i)), testFeature(int64(i), "Test"))
+	}
+
+	rs := testRemoteSync(t, srv, RemoteSyncOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cb, err := rs.SyncFuncWithContext(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sync is cancelled just before the fifth file is synced
+
+	calls := 0
+
+	counted := func(fh io.Reader, ctx context.Context, args ...interface{}) error {
+
+		calls += 1
+
+		if calls == 5 {
+			cancel()
+		}
+
+		return cb(fh, ctx, args...)
+	}
+
+	idx, err := index.NewIndexer("repo", counted)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the crawler used by the repo indexer swallows errors so there's
+	// nothing to check here
+
+	idx.IndexPath(root)
+
+	if calls != 5 {
+		t.Fatalf("Expected the walk to stop after the sync was cancelled but %d of %d files were walked", calls, total)
+	}
+
+	if len(srv.Keys(testBucket)) != 4 {
+		t.Fatalf("Expected 4 files to be synced but got %d", len(srv.Keys(testBucket)))
+	}
+}
+
+func TestRemoteSyncCheckpoint(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	root, files := testRepo(t)
+	defer os.RemoveAll(root)
+
+	fh, err := ioutil.TempFile("", "checkpoint")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh.Close()
+	defer os.Remove(fh.Name())
+
+	// an empty file isn't a valid checkpoint so start from scratch
+
+	opts := RemoteSyncOptions{
+		Checkpoint:       fh.Name(),
+		CheckpointCommit: "abc",
+	}
+
+	rs := testRemoteSync(t, srv, opts)
+	indexRepo(t, rs, root)
+
+	err = rs.CloseCheckpoint(false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Prune = true
+	opts.MaxDeletes = -1
+
+	rs = testRemoteSync(t, srv, opts)
+	indexRepo(t, rs, root)
+
+	counts := rs.Report().Counts
+
+	if counts.Checkpointed != int64(len(files)) || counts.Checked != 0 {
+		t.Fatalf("Expected every file to be skipped using the checkpoint but got %+v", counts)
+	}
+
+	// checkpointed files still count as seen so nothing is pruned
+
+	err = rs.Prune()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.Keys(testBucket)) != len(files) {
+		t.Fatalf("Expected %d keys after pruning but got %d", len(files), len(srv.Keys(testBucket)))
+	}
+
+	err = rs.CloseCheckpoint(false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a checkpoint for a different commit is discarded
+
+	opts.CheckpointCommit = "def"
+
+	rs = testRemoteSync(t, srv, opts)
+	indexRepo(t, rs, root)
+
+	counts = rs.Report().Counts
+
+	if counts.Checkpointed != 0 || counts.Unchanged != int64(len(files)) {
+		t.Fatalf("Expected checkpoint to be discarded but got %+v", counts)
+	}
+
+	err = rs.CloseCheckpoint(true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(fh.Name())
+
+	if !os.IsNotExist(err) {
+		t.Fatal("Expected checkpoint to be removed")
+	}
+}
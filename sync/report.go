@@ -0,0 +1,173 @@
+package sync
+
+// A Report is a machine-readable summary of a RemoteSync run, meant to be
+// written to disk as JSON at the end of a run so that things like CI jobs
+// can decide whether or not to carry on (for example publishing a release)
+// without having to parse log output.
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+type Report struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Seconds  float64        `json:"seconds"`
+	OK       bool           `json:"ok"`
+	Counts   ReportCounts   `json:"counts"`
+	Paths    []*ReportPath  `json:"paths"`
+	Failures []*ReportError `json:"failures"`
+	Errors   []string       `json:"errors"` // errors that aren't specific to a single file, for example pruning
+	Options  ReportOptions  `json:"options"`
+}
+
+type ReportCounts struct {
+	Checked      int64 `json:"checked"`         // WOF records that were passed to SyncFunc
+	Unchanged    int64 `json:"unchanged"`       // records that were the same remotely
+	Uploaded     int64 `json:"uploaded"`        // records that were PUT to the target
+	Skipped      int64 `json:"skipped_non_wof"` // files that were ignored because they aren't WOF records
+	Checkpointed int64 `json:"checkpointed"`    // records that were skipped because a checkpoint says they are already synced
+	Retried      int64 `json:"retried"`         // failed attempts that were queued to be tried again
+	Failed       int64 `json:"failed"`          // records that could not be synced, even after retrying
+	Cancelled    int64 `json:"cancelled"`       // records that weren't synced because the sync was interrupted
+	Deleted      int64 `json:"deleted"`         // remote records that were removed by Prune
+	Bytes        int64 `json:"bytes"`           // the number of (possibly compressed) bytes uploaded
+	WouldUpload  int64 `json:"would_upload"`    // records that would have been uploaded, in dryrun mode
+	WouldDelete  int64 `json:"would_delete"`    // remote records that would have been deleted, in dryrun mode
+}
+
+// ReportPath is the time it took to index one of the paths passed to a sync.
+
+type ReportPath struct {
+	Path    string  `json:"path"`
+	Seconds float64 `json:"seconds"`
+	Indexed int64   `json:"indexed"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type ReportError struct {
+	Path     string `json:"path"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// ReportOptions are the effective options for a sync, which is to say after
+// defaults have been applied. Secrets, like SSE-C keys, are never included.
+
+type ReportOptions struct {
+	Target          string `json:"target"`
+	ACL             string `json:"acl"`
+	RateLimit       int    `json:"rate_limit"`
+	MaxInFlight     int    `json:"max_in_flight"`
+	RequestsPerSec  int    `json:"requests_per_second"`
+	BytesPerSec     int64  `json:"bytes_per_second"`
+	MaxAttempts     int    `json:"max_attempts"`
+	Backoff         string `json:"backoff"`
+	Prune           bool   `json:"prune"`
+	MaxDeletes      int    `json:"max_deletes"`
+	Manifest        string `json:"manifest,omitempty"`
+	ManifestKey     string `json:"manifest_key,omitempty"`
+	Checkpoint      string `json:"checkpoint,omitempty"`
+	RebuildManifest bool   `json:"rebuild_manifest"`
+	Prefetch        bool   `json:"prefetch"`
+	PartSize        int64  `json:"part_size"`
+	Compress        string `json:"compress,omitempty"`
+	Encryption      string `json:"encryption,omitempty"`
+	Rules           bool   `json:"rules"`
+	Force           bool   `json:"force"`
+	Dryrun          bool   `json:"dryrun"`
+}
+
+// syncCounts are updated (atomically) as a RemoteSync runs.
+
+type syncCounts struct {
+	checked      int64
+	unchanged    int64
+	uploaded     int64
+	skipped      int64
+	checkpointed int64
+	retried      int64
+	deleted      int64
+	bytes        int64
+	would_upload int64
+	would_delete int64
+}
+
+func (c *syncCounts) snapshot() ReportCounts {
+
+	counts := ReportCounts{
+		Checked:      atomic.LoadInt64(&c.checked),
+		Unchanged:    atomic.LoadInt64(&c.unchanged),
+		Uploaded:     atomic.LoadInt64(&c.uploaded),
+		Skipped:      atomic.LoadInt64(&c.skipped),
+		Checkpointed: atomic.LoadInt64(&c.checkpointed),
+		Retried:      atomic.LoadInt64(&c.retried),
+		Deleted:      atomic.LoadInt64(&c.deleted),
+		Bytes:        atomic.LoadInt64(&c.bytes),
+		WouldUpload:  atomic.LoadInt64(&c.would_upload),
+		WouldDelete:  atomic.LoadInt64(&c.would_delete),
+	}
+
+	return counts
+}
+
+// AddPath records the time it took to index path, along with the number of
+// records that were indexed and the error, if any, that indexing failed with.
+
+func (r *Report) AddPath(path string, d time.Duration, indexed int64, err error) {
+
+	p := ReportPath{
+		Path:    path,
+		Seconds: d.Seconds(),
+		Indexed: indexed,
+	}
+
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	r.Paths = append(r.Paths, &p)
+}
+
+// AddError records an error that isn't specific to a single file.
+
+func (r *Report) AddError(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Finish sets the finishing time of the report and whether or not the run
+// was successful, which it was if there were no failures or errors, every
+// path was indexed and the sync wasn't interrupted.
+
+func (r *Report) Finish() {
+
+	r.Finished = time.Now()
+	r.Seconds = r.Finished.Sub(r.Started).Seconds()
+
+	ok := len(r.Failures) == 0 && len(r.Errors) == 0 && r.Counts.Cancelled == 0
+
+	for _, p := range r.Paths {
+
+		if p.Error != "" {
+			ok = false
+		}
+	}
+
+	r.OK = ok
+}
+
+// WriteFile (atomically) writes the report to path as indented JSON.
+
+func (r *Report) WriteFile(path string) error {
+
+	body, err := json.MarshalIndent(r, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, bytes.NewReader(body))
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"net"
+	go_sync "sync"
+)
+
+// S3 specific error codes that are worth trying again, in addition to
+// the generic throttling and timeout codes that aws-sdk-go knows about
+
+var retryableS3Codes = map[string]bool{
+	"SlowDown":           true,
+	"InternalError":      true,
+	"ServiceUnavailable": true,
+	"RequestTimeout":     true,
+}
+
+// Failure is a file that could not be synced, even after retrying.
+
+type Failure struct {
+	Path     string
+	Attempts int
+	Error    error
+}
+
+type retryItem struct {
+	path     string
+	body     []byte
+	attempts int
+}
+
+type retryQueue struct {
+	items []*retryItem
+	mu    *go_sync.Mutex
+}
+
+func newRetryQueue() *retryQueue {
+
+	q := retryQueue{
+		items: make([]*retryItem, 0),
+		mu:    new(go_sync.Mutex),
+	}
+
+	return &q
+}
+
+func (q *retryQueue) Push(item *retryItem) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, item)
+}
+
+// Items returns all the items in the queue, without emptying it.
+
+func (q *retryQueue) Items() []*retryItem {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := make([]*retryItem, len(q.items))
+	copy(items, q.items)
+
+	return items
+}
+
+// Drain returns all the items in the queue and empties it.
+
+func (q *retryQueue) Drain() []*retryItem {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = make([]*retryItem, 0)
+
+	return items
+}
+
+// IsRetryableError reports whether err is a (transient) AWS or network error
+// that is likely to succeed if the request is tried again later.
+
+func IsRetryableError(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	if net_err, ok := err.(net.Error); ok {
+		return net_err.Timeout()
+	}
+
+	aws_err, ok := err.(awserr.Error)
+
+	if !ok {
+		return false
+	}
+
+	// s3manager wraps errors in multipart uploads so look at what
+	// actually went wrong
+
+	if aws_err.Code() == "MultipartUpload" && aws_err.OrigErr() != nil {
+		return IsRetryableError(aws_err.OrigErr())
+	}
+
+	if retryableS3Codes[aws_err.Code()] {
+		return true
+	}
+
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+
+	if req_err, ok := err.(awserr.RequestFailure); ok {
+		return req_err.StatusCode() >= 500
+	}
+
+	return false
+}
@@ -0,0 +1,32 @@
+package sync
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"testing"
+)
+
+func TestIsRetryableError(t *testing.T) {
+
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{awserr.New("SlowDown", "Please reduce your request rate.", nil), true},
+		{awserr.New("RequestTimeout", "Timeout", nil), true},
+		{awserr.New("AccessDenied", "Access Denied", nil), false},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "1"), true},
+		{awserr.NewRequestFailure(awserr.New("Whatever", "", nil), 502, "1"), true},
+		{awserr.NewRequestFailure(awserr.New("NoSuchBucket", "", nil), 404, "1"), false},
+		{awserr.New("MultipartUpload", "upload multipart failed", awserr.New("SlowDown", "", nil)), true},
+	}
+
+	for i, test := range tests {
+
+		if IsRetryableError(test.err) != test.retryable {
+			t.Fatalf("Test %d: expected %t for %v", i, test.retryable, test.err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package sync
+
+// Rules assign per-object settings (Cache-Control headers, storage classes
+// and so on) to keys that match a pattern, so that for example alternate
+// geometries or SQLite bundles can be cached differently from primary records.
+// Rules are defined in a JSON file like this:
+//
+//	[
+//		{ "pattern": "*.geojson", "cache_control": "public, max-age=3600" },
+//		{ "pattern": "*-alt-*.geojson", "cache_control": "public, max-age=86400", "storage_class": "STANDARD_IA" },
+//		{ "regexp": "\\.db$", "content_disposition": "attachment", "tags": { "bundle": "true" } }
+//	]
+//
+// Each rule has either a "pattern" (a shell glob) or a "regexp". Globs that
+// don't contain a "/" are matched against the last element of a key, and
+// globs that do are matched against the whole key. Regular expressions are
+// always matched against the whole key. Every rule that matches a key is
+// applied, in order, so later rules override earlier ones.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type Rule struct {
+	Pattern            string            `json:"pattern,omitempty"`
+	Regexp             string            `json:"regexp,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentType        string            `json:"content_type,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	ACL                string            `json:"acl,omitempty"`
+	StorageClass       string            `json:"storage_class,omitempty"`
+	Tags               map[string]string `json:"tags,omitempty"`
+	re                 *regexp.Regexp
+}
+
+type Rules struct {
+	rules []*Rule
+}
+
+// NewRules parses a JSON list of rules from fh.
+
+func NewRules(fh io.Reader) (*Rules, error) {
+
+	rules := make([]*Rule, 0)
+
+	err := json.NewDecoder(fh).Decode(&rules)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range rules {
+
+		err := r.compile()
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule at position %d, %s", i, err)
+		}
+	}
+
+	r := Rules{
+		rules: rules,
+	}
+
+	return &r, nil
+}
+
+func NewRulesFromFile(path string) (*Rules, error) {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fh.Close()
+
+	return NewRules(fh)
+}
+
+// Match reports whether key matches the rule.
+
+func (r *Rule) Match(key string) bool {
+
+	if r.re != nil {
+		return r.re.MatchString(key)
+	}
+
+	candidate := key
+
+	if !strings.Contains(r.Pattern, "/") {
+		candidate = filepath.Base(key)
+	}
+
+	ok, err := filepath.Match(r.Pattern, candidate)
+
+	if err != nil {
+		return false
+	}
+
+	return ok
+}
+
+// Apply updates opts with the settings of every rule that matches key.
+
+func (rs *Rules) Apply(key string, opts *PutOptions) {
+
+	for _, r := range rs.rules {
+
+		if !r.Match(key) {
+			continue
+		}
+
+		if r.CacheControl != "" {
+			opts.CacheControl = r.CacheControl
+		}
+
+		if r.ContentType != "" {
+			opts.ContentType = r.ContentType
+		}
+
+		if r.ContentDisposition != "" {
+			opts.ContentDisposition = r.ContentDisposition
+		}
+
+		if r.ACL != "" {
+			opts.ACL = r.ACL
+		}
+
+		if r.StorageClass != "" {
+			opts.StorageClass = r.StorageClass
+		}
+
+		if len(r.Tags) > 0 {
+
+			if opts.Tags == nil {
+				opts.Tags = make(map[string]string)
+			}
+
+			for k, v := range r.Tags {
+				opts.Tags[k] = v
+			}
+		}
+	}
+}
+
+func (r *Rule) compile() error {
+
+	if r.Pattern == "" && r.Regexp == "" {
+		return errors.New("Rule must have a pattern or a regexp")
+	}
+
+	if r.Pattern != "" && r.Regexp != "" {
+		return errors.New("Rule can not have both a pattern and a regexp")
+	}
+
+	if r.Regexp != "" {
+
+		re, err := regexp.Compile(r.Regexp)
+
+		if err != nil {
+			return err
+		}
+
+		r.re = re
+		return nil
+	}
+
+	// check that the pattern is well-formed
+
+	_, err := filepath.Match(r.Pattern, "")
+	return err
+}
@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-index"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testBucket = "data.whosonfirst.org"
+
+// the fake S3 server doesn't check credentials but aws-sdk-go still
+// wants some to sign requests with
+
+func TestMain(m *testing.M) {
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "fakes3")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "fakes3")
+
+	os.Exit(m.Run())
+}
+
+func testLogger() *log.WOFLogger {
+	return log.NewWOFLogger("test")
+}
+
+func testFeature(id int64, name string) []byte {
+	return []byte(fmt.Sprintf(`{"type":"Feature","properties":{"wof:id":%d,"wof:name":"%s","wof:placetype":"locality","wof:repo":"whosonfirst-data","wof:lastmodified":1562180580},"geometry":{"type":"Point","coordinates":[0,0]}}`, id, name))
+}
+
+// testRepo creates a whosonfirst-data style repo in a temporary directory and
+// returns its path along with a map of (relative) keys to the files' contents.
+
+func testRepo(t *testing.T) (string, map[string][]byte) {
+
+	root, err := ioutil.TempDir("", "whosonfirst-data")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+
+	for id, name := range map[int64]string{101736545: "Montreal", 85632793: "Canada", 1: "Null Island"} {
+
+		rel_path, err := uri.Id2RelPath(id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files[rel_path] = testFeature(id, name)
+	}
+
+	alt_path, err := uri.Id2RelPath(101736545, uri.NewAlternateURIArgs("quattroshapes", ""))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files[alt_path] = testFeature(101736545, "Montreal (alt)")
+
+	for rel_path, body := range files {
+		writeTestFile(t, filepath.Join(root, "data", rel_path), body)
+	}
+
+	// this should be ignored by everything
+
+	writeTestFile(t, filepath.Join(root, "data", "README.md"), []byte("# data"))
+
+	return root, files
+}
+
+func writeTestFile(t *testing.T, path string, body []byte) {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path, body, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRemoteSync(t *testing.T, srv *fakes3.Server, opts RemoteSyncOptions) *RemoteSync {
+
+	opts.DSN = srv.DSN(testBucket, "data")
+	opts.Logger = testLogger()
+
+	if opts.RateLimit == 0 {
+		opts.RateLimit = 100000
+	}
+
+	if opts.ACL == "" {
+		opts.ACL = "public-read"
+	}
+
+	rs, err := NewRemoteSync(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create remote sync, %s", err)
+	}
+
+	return rs
+}
+
+func indexRepo(t *testing.T, s Sync, root string) {
+
+	cb, err := s.SyncFunc()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := index.NewIndexer("repo", cb)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = idx.IndexPath(root)
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %s", root, err)
+	}
+}
@@ -0,0 +1,131 @@
+package sync
+
+// Target is the storage interface that the sync code reads from and writes
+// to. It exists so that RemoteSync and LocalSync aren't hard-wired to S3 and
+// so that they can publish to (or be tested against) something else. Keys are
+// always relative to the root (or prefix) of the target.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("Not found")
+
+type TargetObject struct {
+	Key             string
+	Size            int64
+	ETag            string // without the surrounding quotes
+	LastModified    time.Time
+	ContentEncoding string            // may be empty, and always is for listings
+	Encryption      string            // "AES256", "aws:kms", "SSE-C" or empty (always, for listings)
+	Metadata        map[string]string // lower-cased keys, may be empty
+}
+
+type TargetListCallback func(*TargetObject) error
+
+type PutOptions struct {
+	ACL                string
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	StorageClass       string
+	Tags               map[string]string
+	Metadata           map[string]string
+}
+
+type Target interface {
+	Head(string) (*TargetObject, error)
+	Get(string) (io.ReadCloser, error)
+	Put(string, io.ReadCloser, *PutOptions) error
+	Delete(string) error
+	// List invokes the callback for every object whose key starts with path
+	List(TargetListCallback, string) error
+	URI(string) string
+}
+
+func ValidTargetSchemes() []string {
+
+	valid := []string{
+		"s3",
+		"file",
+		"mem",
+	}
+
+	return valid
+}
+
+// NewTarget returns a new Target for str_uri which is expected to take one
+// of the following forms:
+//
+//	s3://{BUCKET}/{PREFIX}?region={REGION}&credentials={CREDENTIALS}&endpoint={ENDPOINT}&path-style={BOOL}&disable-ssl={BOOL}&part-size={BYTES}&sse={SSE}&sse-kms-key-id={KEY}&sse-c-key-file={PATH}
+//	file:///{PATH}
+//	mem://
+
+func NewTarget(str_uri string) (Target, error) {
+
+	u, err := url.Parse(str_uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return NewS3TargetFromURI(u)
+	case "file":
+		return NewFSTarget(u.Path)
+	case "mem":
+		return NewMemoryTarget()
+	default:
+		return nil, fmt.Errorf("Invalid target scheme '%s'. Valid schemes are: %s", u.Scheme, strings.Join(ValidTargetSchemes(), ", "))
+	}
+}
+
+// IsNotFound reports whether err is the error that a Target returns when a
+// key does not exist.
+
+func IsNotFound(err error) bool {
+	return err == ErrNotFound
+}
+
+// newTargetWithURIOrDSN returns a new Target for str_uri, if it is not
+// empty, or an S3 target for dsn (a go-whosonfirst-aws DSN string). If enc
+// is not nil its settings are merged with str_uri or dsn.
+
+func newTargetWithURIOrDSN(str_uri string, dsn string, enc *EncryptionOptions) (Target, error) {
+
+	if str_uri != "" {
+
+		if enc != nil {
+
+			merged, err := enc.mergeURI(str_uri)
+
+			if err != nil {
+				return nil, err
+			}
+
+			str_uri = merged
+		}
+
+		return NewTarget(str_uri)
+	}
+
+	if enc != nil {
+
+		merged, err := enc.mergeDSN(dsn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dsn = merged
+	}
+
+	return NewS3TargetFromDSN(dsn)
+}
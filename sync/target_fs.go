@@ -0,0 +1,237 @@
+package sync
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FSTarget stores objects as files in a local directory. ETags are the
+// MD5 hash of a file's contents, as they are for (most) S3 objects.
+
+type FSTarget struct {
+	Target
+	root string
+}
+
+func NewFSTarget(root string) (*FSTarget, error) {
+
+	if root == "" {
+		return nil, errors.New("Missing root directory")
+	}
+
+	abs_root, err := filepath.Abs(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(abs_root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, errors.New("Root is not a directory")
+	}
+
+	t := FSTarget{
+		root: abs_root,
+	}
+
+	return &t, nil
+}
+
+func (t *FSTarget) Head(key string) (*TargetObject, error) {
+
+	path := t.path(key)
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+
+	return t.object(key, path, info)
+}
+
+func (t *FSTarget) Get(key string) (io.ReadCloser, error) {
+
+	fh, err := os.Open(t.path(key))
+
+	if err != nil {
+
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return fh, nil
+}
+
+func (t *FSTarget) Put(key string, fh io.ReadCloser, opts *PutOptions) error {
+
+	defer fh.Close()
+
+	return writeFileAtomic(t.path(key), fh)
+}
+
+func (t *FSTarget) Delete(key string) error {
+
+	err := os.Remove(t.path(key))
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (t *FSTarget) List(cb TargetListCallback, path string) error {
+
+	// walk the deepest directory that contains path and then filter
+	// on the key so that path behaves like an S3 prefix
+
+	start := t.path(path)
+
+	info, err := os.Stat(start)
+
+	if err != nil || !info.IsDir() {
+		start = filepath.Dir(start)
+	}
+
+	walk_cb := func(abs_path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		key, err := filepath.Rel(t.root, abs_path)
+
+		if err != nil {
+			return err
+		}
+
+		key = filepath.ToSlash(key)
+
+		if !strings.HasPrefix(key, path) {
+			return nil
+		}
+
+		// skip temporary files from writeFileAtomic
+
+		if strings.HasPrefix(filepath.Base(key), ".wof-s3-sync-") {
+			return nil
+		}
+
+		obj, err := t.object(key, abs_path, info)
+
+		if err != nil {
+			return err
+		}
+
+		return cb(obj)
+	}
+
+	return filepath.Walk(start, walk_cb)
+}
+
+func (t *FSTarget) URI(key string) string {
+	return "file://" + t.path(key)
+}
+
+func (t *FSTarget) path(key string) string {
+	return filepath.Join(t.root, filepath.FromSlash(key))
+}
+
+func (t *FSTarget) object(key string, path string, info os.FileInfo) (*TargetObject, error) {
+
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	enc := md5.Sum(body)
+
+	obj := TargetObject{
+		Key:          key,
+		Size:         info.Size(),
+		ETag:         hex.EncodeToString(enc[:]),
+		LastModified: info.ModTime(),
+	}
+
+	return &obj, nil
+}
+
+// writeFileAtomic writes fh to a temporary file in the same directory as path
+// and then renames it so that an interrupted write never leaves a partial file.
+
+func writeFileAtomic(path string, fh io.Reader) error {
+
+	root := filepath.Dir(path)
+
+	err := os.MkdirAll(root, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(root, ".wof-s3-sync-")
+
+	if err != nil {
+		return err
+	}
+
+	tmp_path := tmp.Name()
+
+	_, err = io.Copy(tmp, fh)
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp_path)
+		return err
+	}
+
+	err = tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp_path)
+		return err
+	}
+
+	err = os.Chmod(tmp_path, 0644)
+
+	if err != nil {
+		os.Remove(tmp_path)
+		return err
+	}
+
+	return os.Rename(tmp_path, path)
+}
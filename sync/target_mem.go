@@ -0,0 +1,164 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	go_sync "sync"
+	"time"
+)
+
+type memoryObject struct {
+	body         []byte
+	etag         string
+	lastmodified time.Time
+	encoding     string
+	metadata     map[string]string
+}
+
+// MemoryTarget stores objects in memory. It is mostly useful for testing.
+
+type MemoryTarget struct {
+	Target
+	objects map[string]*memoryObject
+	mu      *go_sync.RWMutex
+}
+
+func NewMemoryTarget() (*MemoryTarget, error) {
+
+	t := MemoryTarget{
+		objects: make(map[string]*memoryObject),
+		mu:      new(go_sync.RWMutex),
+	}
+
+	return &t, nil
+}
+
+func (t *MemoryTarget) Head(key string) (*TargetObject, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	mem_obj, ok := t.objects[key]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return t.object(key, mem_obj), nil
+}
+
+func (t *MemoryTarget) Get(key string) (io.ReadCloser, error) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	mem_obj, ok := t.objects[key]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(mem_obj.body)), nil
+}
+
+func (t *MemoryTarget) Put(key string, fh io.ReadCloser, opts *PutOptions) error {
+
+	defer fh.Close()
+
+	body, err := ioutil.ReadAll(fh)
+
+	if err != nil {
+		return err
+	}
+
+	enc := md5.Sum(body)
+
+	mem_obj := memoryObject{
+		body:         body,
+		etag:         hex.EncodeToString(enc[:]),
+		lastmodified: time.Now(),
+		metadata:     make(map[string]string),
+	}
+
+	if opts != nil {
+
+		mem_obj.encoding = opts.ContentEncoding
+
+		for k, v := range opts.Metadata {
+			mem_obj.metadata[strings.ToLower(k)] = v
+		}
+	}
+
+	t.mu.Lock()
+	t.objects[key] = &mem_obj
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (t *MemoryTarget) Delete(key string) error {
+
+	t.mu.Lock()
+	delete(t.objects, key)
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (t *MemoryTarget) List(cb TargetListCallback, path string) error {
+
+	t.mu.RLock()
+
+	objects := make([]*TargetObject, 0)
+
+	for key, mem_obj := range t.objects {
+
+		if strings.HasPrefix(key, path) {
+			objects = append(objects, t.object(key, mem_obj))
+		}
+	}
+
+	t.mu.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	for _, obj := range objects {
+
+		err := cb(obj)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *MemoryTarget) URI(key string) string {
+	return "mem://" + key
+}
+
+func (t *MemoryTarget) object(key string, mem_obj *memoryObject) *TargetObject {
+
+	obj := TargetObject{
+		Key:             key,
+		Size:            int64(len(mem_obj.body)),
+		ETag:            mem_obj.etag,
+		LastModified:    mem_obj.lastmodified,
+		ContentEncoding: mem_obj.encoding,
+		Metadata:        make(map[string]string),
+	}
+
+	for k, v := range mem_obj.metadata {
+		obj.Metadata[k] = v
+	}
+
+	return &obj
+}
@@ -0,0 +1,238 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/whosonfirst/go-whosonfirst-s3"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type S3Target struct {
+	Target
+	conn *s3.S3Connection
+}
+
+func NewS3TargetFromDSN(dsn string) (*S3Target, error) {
+
+	cfg, err := s3.NewS3ConfigFromString(dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewS3Target(cfg)
+}
+
+func NewS3TargetFromURI(u *url.URL) (*S3Target, error) {
+
+	q := u.Query()
+
+	cfg := s3.S3Config{
+		Bucket:      u.Host,
+		Prefix:      strings.Trim(u.Path, "/"),
+		Region:      q.Get("region"),
+		Credentials: q.Get("credentials"),
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	cfg.Endpoint = q.Get("endpoint")
+
+	cfg.SSE = q.Get("sse")
+	cfg.SSEKMSKeyId = q.Get("sse-kms-key-id")
+
+	key_file := q.Get("sse-c-key-file")
+
+	if key_file != "" {
+
+		key, err := s3.ReadSSECustomerKey(key_file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.SSECustomerKey = key
+	}
+
+	str_part_size := q.Get("part-size")
+
+	if str_part_size != "" {
+
+		part_size, err := strconv.ParseInt(str_part_size, 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid part-size value '%s'", str_part_size)
+		}
+
+		cfg.PartSize = part_size
+	}
+
+	for _, k := range []string{"path-style", "disable-ssl"} {
+
+		str_v := q.Get(k)
+
+		if str_v == "" {
+			continue
+		}
+
+		v, err := strconv.ParseBool(str_v)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s value '%s'", k, str_v)
+		}
+
+		switch k {
+		case "path-style":
+			cfg.PathStyle = v
+		case "disable-ssl":
+			cfg.DisableSSL = v
+		}
+	}
+
+	return NewS3Target(&cfg)
+}
+
+func NewS3Target(cfg *s3.S3Config) (*S3Target, error) {
+
+	conn, err := s3.NewS3Connection(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := S3Target{
+		conn: conn,
+	}
+
+	return &t, nil
+}
+
+func (t *S3Target) Head(key string) (*TargetObject, error) {
+
+	rsp, err := t.conn.Head(key)
+
+	if err != nil {
+
+		if s3.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	obj := TargetObject{
+		Key: key,
+	}
+
+	if rsp.ContentLength != nil {
+		obj.Size = *rsp.ContentLength
+	}
+
+	if rsp.ETag != nil {
+		obj.ETag = strings.Trim(*rsp.ETag, "\"")
+	}
+
+	if rsp.LastModified != nil {
+		obj.LastModified = *rsp.LastModified
+	}
+
+	if rsp.ContentEncoding != nil {
+		obj.ContentEncoding = *rsp.ContentEncoding
+	}
+
+	if rsp.SSECustomerAlgorithm != nil {
+		obj.Encryption = "SSE-C"
+	} else if rsp.ServerSideEncryption != nil {
+		obj.Encryption = *rsp.ServerSideEncryption
+	}
+
+	// aws-sdk-go canonicalizes metadata keys (for example "Sha256") so
+	// make sure they are all lower case
+
+	obj.Metadata = make(map[string]string)
+
+	for k, v := range rsp.Metadata {
+		obj.Metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	return &obj, nil
+}
+
+func (t *S3Target) Get(key string) (io.ReadCloser, error) {
+
+	fh, err := t.conn.Get(key)
+
+	if err != nil {
+
+		if s3.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return fh, nil
+}
+
+func (t *S3Target) Put(key string, fh io.ReadCloser, opts *PutOptions) error {
+
+	s3_opts := s3.S3PutOptions{}
+
+	if opts != nil {
+		s3_opts.ACL = opts.ACL
+		s3_opts.ContentType = opts.ContentType
+		s3_opts.ContentEncoding = opts.ContentEncoding
+		s3_opts.CacheControl = opts.CacheControl
+		s3_opts.ContentDisposition = opts.ContentDisposition
+		s3_opts.StorageClass = opts.StorageClass
+		s3_opts.Tags = opts.Tags
+		s3_opts.Metadata = opts.Metadata
+	}
+
+	return t.conn.Put(key, fh, &s3_opts)
+}
+
+func (t *S3Target) Delete(key string) error {
+	return t.conn.Delete(key)
+}
+
+func (t *S3Target) List(cb TargetListCallback, path string) error {
+
+	s3_cb := func(s3_obj *s3.S3Object) error {
+
+		obj := TargetObject{
+			Key:          s3_obj.Key,
+			Size:         s3_obj.Size,
+			ETag:         strings.Trim(s3_obj.ETag, "\""),
+			LastModified: s3_obj.LastModified,
+		}
+
+		return cb(&obj)
+	}
+
+	opts := s3.DefaultS3ListOptions()
+	opts.Path = path
+
+	return t.conn.List(s3_cb, opts)
+}
+
+// Encryption returns the server-side encryption applied to uploads.
+
+func (t *S3Target) Encryption() string {
+	return t.conn.Encryption()
+}
+
+// PartSize returns the size, in bytes, of each part in a multipart upload.
+
+func (t *S3Target) PartSize() int64 {
+	return t.conn.PartSize()
+}
+
+func (t *S3Target) URI(key string) string {
+	return t.conn.URI(key)
+}
@@ -0,0 +1,253 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-s3/fakes3"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	go_sync "sync"
+	"testing"
+)
+
+func testTargets(t *testing.T) (map[string]Target, func()) {
+
+	srv := fakes3.NewServer(testBucket)
+
+	s3_t, err := NewS3TargetFromDSN(srv.DSN(testBucket, "data"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := ioutil.TempDir("", "target")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs_t, err := NewTarget("file://" + root)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem_t, err := NewTarget("mem://")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := map[string]Target{
+		"s3":   s3_t,
+		"file": fs_t,
+		"mem":  mem_t,
+	}
+
+	cleanup := func() {
+		srv.Close()
+		os.RemoveAll(root)
+	}
+
+	return targets, cleanup
+}
+
+func TestTargets(t *testing.T) {
+
+	targets, cleanup := testTargets(t)
+	defer cleanup()
+
+	key := "101/736/545/101736545.geojson"
+	body := testFeature(101736545, "Montreal")
+
+	enc := md5.Sum(body)
+	etag := hex.EncodeToString(enc[:])
+
+	for name, tg := range targets {
+
+		_, err := tg.Head(key)
+
+		if !IsNotFound(err) {
+			t.Fatalf("[%s] Expected not found error but got %v", name, err)
+		}
+
+		err = tg.Put(key, ioutil.NopCloser(bytes.NewReader(body)), &PutOptions{ACL: "public-read"})
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to put %s, %s", name, key, err)
+		}
+
+		err = tg.Put("101/736/545/101736545-alt-quattroshapes.geojson", ioutil.NopCloser(bytes.NewReader(body)), nil)
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to put alt file, %s", name, err)
+		}
+
+		obj, err := tg.Head(key)
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to head %s, %s", name, key, err)
+		}
+
+		if obj.Size != int64(len(body)) {
+			t.Fatalf("[%s] Unexpected size %d", name, obj.Size)
+		}
+
+		if obj.ETag != etag {
+			t.Fatalf("[%s] Unexpected ETag '%s'", name, obj.ETag)
+		}
+
+		fh, err := tg.Get(key)
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to get %s, %s", name, key, err)
+		}
+
+		remote, err := ioutil.ReadAll(fh)
+		fh.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(remote, body) {
+			t.Fatalf("[%s] Unexpected body", name)
+		}
+
+		keys := make([]string, 0)
+		mu := new(go_sync.Mutex)
+
+		cb := func(obj *TargetObject) error {
+			mu.Lock()
+			keys = append(keys, obj.Key)
+			mu.Unlock()
+			return nil
+		}
+
+		err = tg.List(cb, "101/736/545/101736545-")
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to list, %s", name, err)
+		}
+
+		if len(keys) != 1 || keys[0] != "101/736/545/101736545-alt-quattroshapes.geojson" {
+			t.Fatalf("[%s] Unexpected keys for prefix: %v", name, keys)
+		}
+
+		keys = make([]string, 0)
+
+		err = tg.List(cb, "")
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to list, %s", name, err)
+		}
+
+		sort.Strings(keys)
+
+		if len(keys) != 2 || keys[1] != key {
+			t.Fatalf("[%s] Unexpected keys: %v", name, keys)
+		}
+
+		err = tg.Delete(key)
+
+		if err != nil {
+			t.Fatalf("[%s] Failed to delete %s, %s", name, key, err)
+		}
+
+		_, err = tg.Get(key)
+
+		if !IsNotFound(err) {
+			t.Fatalf("[%s] Expected not found error after delete but got %v", name, err)
+		}
+	}
+}
+
+func TestNewTargetInvalid(t *testing.T) {
+
+	_, err := NewTarget("ftp://example.com")
+
+	if err == nil {
+		t.Fatal("Expected an error for an invalid scheme")
+	}
+}
+
+func TestNewTargetS3Endpoint(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	uri := fmt.Sprintf("s3://%s/data?credentials=env:&endpoint=%s&path-style=true", testBucket, url.QueryEscape(srv.URL))
+
+	s3_t, err := NewTarget(uri)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s3_t.Put("test.txt", ioutil.NopCloser(bytes.NewReader([]byte("hello"))), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.Object(testBucket, "data/test.txt") == nil {
+		t.Fatal("Missing object for data/test.txt")
+	}
+
+	_, err = NewTarget(uri + "&disable-ssl=maybe")
+
+	if err == nil {
+		t.Fatal("Expected an error for an invalid disable-ssl value")
+	}
+}
+
+func TestNewTargetS3CustomerKey(t *testing.T) {
+
+	srv := fakes3.NewServer(testBucket)
+	defer srv.Close()
+
+	fh, err := ioutil.TempFile("", "sse-c")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(fh.Name())
+
+	fh.Write(bytes.Repeat([]byte("k"), 31))
+	fh.Close()
+
+	uri := fmt.Sprintf("s3://%s/data?credentials=env:&endpoint=%s&path-style=true&sse-c-key-file=%s", testBucket, url.QueryEscape(srv.URL), url.QueryEscape(fh.Name()))
+
+	_, err = NewTarget(uri)
+
+	if err == nil {
+		t.Fatal("Expected an error for an invalid SSE-C key")
+	}
+
+	err = ioutil.WriteFile(fh.Name(), bytes.Repeat([]byte("k"), 32), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3_t, err := NewTarget(uri)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// aws-sdk-go refuses to send SSE-C keys over plain HTTP, which is
+	// what the fake S3 server speaks
+
+	err = s3_t.Put("test.txt", ioutil.NopCloser(bytes.NewReader([]byte("hello"))), nil)
+
+	if err == nil || !strings.Contains(err.Error(), "SSE keys") {
+		t.Fatalf("Expected an SSE-C over HTTP error but got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"math"
+	go_sync "sync"
+	"time"
+)
+
+// AdaptiveThrottle is a Throttle whose requests per second limit is adjusted,
+// AIMD style, from the outcomes passed to Report. Throttling errors (see
+// IsThrottlingError) halve the rate, at most once per Cooldown so that a
+// burst of errors from requests that were already in flight doesn't collapse
+// it entirely, and a second's worth of successful requests (at the current
+// rate) raise it by Increase, up to the maximum rate.
+
+type AdaptiveThrottle struct {
+	Throttle
+	MinRate   float64
+	Increase  float64
+	Decrease  float64 // the factor the rate is multiplied by when backing off
+	Cooldown  time.Duration
+	bucket    *TokenBucket
+	rate      float64
+	max_rate  float64
+	successes int
+	backoff   time.Time
+	mu        *go_sync.Mutex
+}
+
+// NewAdaptiveThrottle returns an AdaptiveThrottle that starts at, and never
+// exceeds, max_per_sec requests per second. By default the rate is increased
+// by a twentieth of max_per_sec (or 1) at a time and never drops below 1.
+
+func NewAdaptiveThrottle(max_per_sec int) (*AdaptiveThrottle, error) {
+
+	if max_per_sec < 1 {
+		return nil, errors.New("Maximum rate must be greater than zero")
+	}
+
+	max_rate := float64(max_per_sec)
+
+	bucket, err := NewTokenBucket(max_rate, max_rate)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := AdaptiveThrottle{
+		MinRate:  1,
+		Increase: math.Max(1, max_rate/20),
+		Decrease: 0.5,
+		Cooldown: 1 * time.Second,
+		bucket:   bucket,
+		rate:     max_rate,
+		max_rate: max_rate,
+		mu:       new(go_sync.Mutex),
+	}
+
+	return &t, nil
+}
+
+func (t *AdaptiveThrottle) RateLimit() error {
+	return t.bucket.RateLimit()
+}
+
+func (t *AdaptiveThrottle) RateLimitContext(ctx context.Context) error {
+	return t.bucket.RateLimitContext(ctx)
+}
+
+// Report adjusts the rate according to the outcome of a request.
+
+func (t *AdaptiveThrottle) Report(err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+
+		t.successes += 1
+
+		if float64(t.successes) < t.rate {
+			return
+		}
+
+		t.successes = 0
+		t.setRate(math.Min(t.rate+t.Increase, t.max_rate))
+		return
+	}
+
+	if !IsThrottlingError(err) {
+		return
+	}
+
+	t.successes = 0
+
+	now := time.Now()
+
+	if now.Sub(t.backoff) < t.Cooldown {
+		return
+	}
+
+	t.backoff = now
+	t.setRate(math.Max(t.rate*t.Decrease, t.MinRate))
+}
+
+// Rate returns the current requests per second limit.
+
+func (t *AdaptiveThrottle) Rate() float64 {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.rate
+}
+
+func (t *AdaptiveThrottle) setRate(rate float64) {
+
+	if rate == t.rate {
+		return
+	}
+
+	t.rate = rate
+	t.bucket.setRate(rate, rate)
+}
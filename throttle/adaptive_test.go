@@ -0,0 +1,116 @@
+package throttle
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveThrottle(t *testing.T) {
+
+	th, err := NewAdaptiveThrottle(100)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow_down := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "")
+
+	th.Report(slow_down)
+
+	if th.Rate() != 50 {
+		t.Fatalf("Expected rate to be halved but it is %f", th.Rate())
+	}
+
+	// errors from requests that were already in flight are ignored
+
+	th.Report(slow_down)
+
+	if th.Rate() != 50 {
+		t.Fatalf("Expected rate to be unchanged during cooldown but it is %f", th.Rate())
+	}
+
+	// as are errors that aren't about throttling
+
+	th.Cooldown = 0
+	th.Report(errors.New("Something else"))
+	th.Report(awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""))
+
+	if th.Rate() != 50 {
+		t.Fatalf("Expected rate to be unchanged but it is %f", th.Rate())
+	}
+
+	// a second's worth of successes increases the rate
+
+	for i := 0; i < 50; i++ {
+		th.Report(nil)
+	}
+
+	if th.Rate() != 55 {
+		t.Fatalf("Expected rate to be increased but it is %f", th.Rate())
+	}
+
+	// but never past the minimum or maximum
+
+	for i := 0; i < 20; i++ {
+		th.Report(slow_down)
+	}
+
+	if th.Rate() != th.MinRate {
+		t.Fatalf("Expected rate to be %f but it is %f", th.MinRate, th.Rate())
+	}
+
+	for i := 0; i < 100000; i++ {
+		th.Report(nil)
+	}
+
+	if th.Rate() != 100 {
+		t.Fatalf("Expected rate to be 100 but it is %f", th.Rate())
+	}
+
+	// and the rate limit is actually applied
+
+	th.Report(slow_down)
+	th.Report(slow_down)
+
+	t1 := time.Now()
+
+	for i := 0; i < 10; i++ {
+		th.RateLimit()
+	}
+
+	if time.Since(t1) < 50*time.Millisecond {
+		t.Fatalf("Expected to be throttled but took %v", time.Since(t1))
+	}
+}
+
+func TestIsThrottlingError(t *testing.T) {
+
+	throttling := []error{
+		awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Service Unavailable", nil), 503, ""),
+		awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, ""),
+		awserr.New("MultipartUpload", "upload multipart failed", awserr.New("RequestTimeout", "", nil)),
+	}
+
+	for _, err := range throttling {
+
+		if !IsThrottlingError(err) {
+			t.Fatalf("Expected %s to be a throttling error", err)
+		}
+	}
+
+	not_throttling := []error{
+		nil,
+		errors.New("SlowDown"),
+		awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""),
+	}
+
+	for _, err := range not_throttling {
+
+		if IsThrottlingError(err) {
+			t.Fatalf("Expected %v not to be a throttling error", err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	go_sync "sync"
+	"time"
+)
+
+// TokenBucket is a Throttle that allows rate tokens per second, with bursts of
+// up to burst tokens. Callers can take more than one token at a time, for
+// example one per byte when limiting bandwidth, and requests for more tokens
+// than are available (or than burst) are allowed but the caller is made to
+// wait until the bucket has refilled enough to pay for them.
+
+type TokenBucket struct {
+	Throttle
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     *go_sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst float64) (*TokenBucket, error) {
+
+	if rate <= 0 {
+		return nil, errors.New("Rate must be greater than zero")
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	b := TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		mu:     new(go_sync.Mutex),
+	}
+
+	return &b, nil
+}
+
+// NewRequestsThrottle returns a Throttle that allows per_sec requests per
+// second, with bursts of up to one second's worth of requests.
+
+func NewRequestsThrottle(per_sec int) (Throttle, error) {
+	return NewTokenBucket(float64(per_sec), float64(per_sec))
+}
+
+func (b *TokenBucket) RateLimit() error {
+	b.Wait(1)
+	return nil
+}
+
+func (b *TokenBucket) RateLimitContext(ctx context.Context) error {
+	return b.WaitContext(ctx, 1)
+}
+
+func (b *TokenBucket) Report(err error) {
+	// pass
+}
+
+// Wait blocks until n tokens have been taken from the bucket.
+
+func (b *TokenBucket) Wait(n float64) {
+
+	d := b.reserve(n)
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// WaitContext blocks until n tokens have been taken from the bucket or ctx is
+// cancelled, in which case the tokens are returned to the bucket and
+// ctx.Err() is returned.
+
+func (b *TokenBucket) WaitContext(ctx context.Context, n float64) error {
+
+	err := ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	err = sleep(ctx, b.reserve(n))
+
+	if err != nil {
+		b.mu.Lock()
+		b.tokens += n
+		b.mu.Unlock()
+	}
+
+	return err
+}
+
+// setRate changes the rate and burst of the bucket, keeping whatever tokens
+// it currently has up to the new burst.
+
+func (b *TokenBucket) setRate(rate float64, burst float64) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	b.rate = rate
+	b.burst = burst
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// reserve takes n tokens from the bucket, even if that leaves it in debt,
+// and returns how long the caller needs to wait for that debt to be paid.
+
+func (b *TokenBucket) reserve(n float64) time.Duration {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,73 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	b, err := NewTokenBucket(100, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first 10 are free, the next 10 should take about 100ms
+
+	t1 := time.Now()
+
+	for i := 0; i < 20; i++ {
+		b.RateLimit()
+	}
+
+	d := time.Since(t1)
+
+	if d < 80*time.Millisecond {
+		t.Fatalf("Expected to wait at least 80ms but waited %v", d)
+	}
+
+	// more than the burst is allowed, but has to be paid for
+
+	t1 = time.Now()
+	b.Wait(5)
+
+	if time.Since(t1) < 40*time.Millisecond {
+		t.Fatalf("Expected to wait at least 40ms but waited %v", time.Since(t1))
+	}
+
+	_, err = NewTokenBucket(0, 10)
+
+	if err == nil {
+		t.Fatal("Expected an error for a zero rate")
+	}
+}
+
+func TestTokenBucketContext(t *testing.T) {
+
+	b, err := NewTokenBucket(1, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.RateLimit()
+
+	// the next token isn't available for a second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	t1 := time.Now()
+
+	err = b.RateLimitContext(ctx)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected a deadline exceeded error but got %v", err)
+	}
+
+	if time.Since(t1) > 500*time.Millisecond {
+		t.Fatalf("Expected to return when the context was cancelled but waited %v", time.Since(t1))
+	}
+}
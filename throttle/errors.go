@@ -0,0 +1,49 @@
+package throttle
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"net/http"
+)
+
+// S3 error codes that mean we are making too many requests, in addition to
+// the generic throttling codes that aws-sdk-go knows about
+
+var throttlingCodes = map[string]bool{
+	"SlowDown":           true,
+	"ServiceUnavailable": true,
+	"RequestTimeout":     true,
+}
+
+// IsThrottlingError reports whether err means that the remote service would
+// like us to slow down, for example an S3 SlowDown or 503 error.
+
+func IsThrottlingError(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	aws_err, ok := err.(awserr.Error)
+
+	if !ok {
+		return false
+	}
+
+	// s3manager wraps errors in multipart uploads so look at what
+	// actually went wrong
+
+	if aws_err.Code() == "MultipartUpload" && aws_err.OrigErr() != nil {
+		return IsThrottlingError(aws_err.OrigErr())
+	}
+
+	if throttlingCodes[aws_err.Code()] || request.IsErrorThrottle(err) {
+		return true
+	}
+
+	if req_err, ok := err.(awserr.RequestFailure); ok {
+		return req_err.StatusCode() == http.StatusServiceUnavailable
+	}
+
+	return false
+}
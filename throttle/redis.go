@@ -0,0 +1,160 @@
+package throttle
+
+// RedisThrottle shares a requests per second limit between any number of
+// processes, on any number of hosts, by storing the state of a GCRA rate
+// limiter (the same one that ThrottledThrottle uses) in Redis using the
+// throttled library's redigo store. Unlike counting requests in fixed windows
+// this spaces requests out evenly so there is never a burst of (up to) twice
+// the limit at the boundary between two windows. The time is read from Redis
+// so the clocks of the hosts doing the syncing don't matter.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/redigostore"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redisTimeout = 5 * time.Second
+
+type RedisThrottle struct {
+	Throttle
+	throttled *ThrottledThrottle
+	pool      *redis.Pool
+}
+
+// NewRedisThrottle returns a RedisThrottle that allows per_sec requests per
+// second across every process using the same Redis server and key. The URI
+// looks like redis://[:{PASSWORD}@]{HOST}[:{PORT}]/{KEY}?db={DB} where KEY
+// defaults to "wof-s3-sync" and DB to 0.
+
+func NewRedisThrottle(str_uri string, per_sec int) (*RedisThrottle, error) {
+
+	if per_sec < 1 {
+		return nil, errors.New("Rate must be greater than zero")
+	}
+
+	u, err := url.Parse(str_uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("Invalid scheme '%s'", u.Scheme)
+	}
+
+	addr := u.Host
+
+	if addr == "" {
+		return nil, errors.New("Missing Redis host")
+	}
+
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	key := strings.Trim(u.Path, "/")
+
+	if key == "" {
+		key = "wof-s3-sync"
+	}
+
+	db := 0
+	str_db := u.Query().Get("db")
+
+	if str_db != "" {
+
+		db, err = strconv.Atoi(str_db)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid db '%s'", str_db)
+		}
+	}
+
+	password := ""
+
+	if u.User != nil {
+
+		password, _ = u.User.Password()
+
+		if password == "" {
+			password = u.User.Username()
+		}
+	}
+
+	dial := func() (redis.Conn, error) {
+
+		return redis.Dial("tcp", addr,
+			redis.DialPassword(password),
+			redis.DialDatabase(db),
+			redis.DialConnectTimeout(redisTimeout),
+			redis.DialReadTimeout(redisTimeout),
+			redis.DialWriteTimeout(redisTimeout),
+		)
+	}
+
+	pool := &redis.Pool{
+		Dial:        dial,
+		MaxIdle:     10,
+		IdleTimeout: 5 * time.Minute,
+	}
+
+	// connect now so that a bad address (or password) is reported straight away
+
+	conn := pool.Get()
+	_, err = conn.Do("PING")
+	conn.Close()
+
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	st, err := redigostore.New(pool, "", db)
+
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	burst := int(float64(per_sec) / 10.)
+	quota := throttled.RateQuota{MaxRate: throttled.PerSec(per_sec), MaxBurst: burst}
+
+	th, err := newThrottledThrottle(st, key, quota)
+
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	t := RedisThrottle{
+		throttled: th,
+		pool:      pool,
+	}
+
+	return &t, nil
+}
+
+func (t *RedisThrottle) RateLimit() error {
+	return t.RateLimitContext(context.Background())
+}
+
+func (t *RedisThrottle) RateLimitContext(ctx context.Context) error {
+	return t.throttled.RateLimitContext(ctx)
+}
+
+func (t *RedisThrottle) Report(err error) {
+	// pass
+}
+
+func (t *RedisThrottle) Close() error {
+	return t.pool.Close()
+}
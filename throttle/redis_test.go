@@ -0,0 +1,284 @@
+package throttle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	go_sync "sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a (very) minimal in-process Redis server that supports the
+// commands the throttled library's redigo store uses. Keys never expire and
+// EVAL only knows how to run the store's compare-and-swap script.
+
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	values   map[string]string
+	mu       *go_sync.Mutex
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := fakeRedis{
+		listener: l,
+		password: password,
+		values:   make(map[string]string),
+		mu:       new(go_sync.Mutex),
+	}
+
+	go func() {
+
+		for {
+
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go r.serve(conn)
+		}
+	}()
+
+	return &r
+}
+
+func (r *fakeRedis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) Close() {
+	r.listener.Close()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authed := r.password == ""
+
+	for {
+
+		cmd, err := readCommand(reader)
+
+		if err != nil {
+			return
+		}
+
+		name := strings.ToUpper(cmd[0])
+
+		var rsp string
+
+		switch {
+		case name == "AUTH":
+
+			if cmd[1] == r.password {
+				authed = true
+				rsp = "+OK\r\n"
+			} else {
+				rsp = "-ERR invalid password\r\n"
+			}
+
+		case !authed:
+			rsp = "-NOAUTH Authentication required.\r\n"
+		case name == "PING":
+			rsp = "+PONG\r\n"
+		case name == "SELECT":
+			rsp = "+OK\r\n"
+		default:
+			r.mu.Lock()
+			rsp = r.do(name, cmd[1:])
+			r.mu.Unlock()
+		}
+
+		_, err = io.WriteString(conn, rsp)
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// do runs a command (other than the connection-level ones) and returns its
+// RESP encoded reply. r.mu must be held.
+
+func (r *fakeRedis) do(name string, args []string) string {
+
+	switch name {
+	case "TIME":
+
+		now := time.Now()
+		s := strconv.FormatInt(now.Unix(), 10)
+		us := strconv.Itoa(now.Nanosecond() / 1000)
+
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(s), s, len(us), us)
+
+	case "GET":
+
+		v, ok := r.values[args[0]]
+
+		if !ok {
+			return "$-1\r\n"
+		}
+
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+
+	case "SETNX":
+
+		_, ok := r.values[args[0]]
+
+		if ok {
+			return ":0\r\n"
+		}
+
+		r.values[args[0]] = args[1]
+		return ":1\r\n"
+
+	case "EXPIRE":
+		return ":1\r\n"
+	case "EVAL":
+
+		// EVAL {SCRIPT} 1 {KEY} {OLD} {NEW} {TTL}
+
+		v, ok := r.values[args[2]]
+
+		if !ok {
+			return "-ERR key does not exist\r\n"
+		}
+
+		if v != args[3] {
+			return ":0\r\n"
+		}
+
+		r.values[args[2]] = args[4]
+		return ":1\r\n"
+
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", name)
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+
+	ln, err := reader.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(ln)[1:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := make([]string, count)
+
+	for i := 0; i < count; i++ {
+
+		ln, err := reader.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(ln)[1:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+
+		_, err = io.ReadFull(reader, buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cmd[i] = string(buf[:size])
+	}
+
+	return cmd, nil
+}
+
+func TestRedisThrottle(t *testing.T) {
+
+	srv := newFakeRedis(t, "s33kret")
+	defer srv.Close()
+
+	uri := fmt.Sprintf("redis://:s33kret@%s/test?db=1", srv.Addr())
+
+	// two throttles sharing the same limit, like two separate processes
+
+	th1, err := NewRedisThrottle(uri, 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer th1.Close()
+
+	th2, err := NewRedisThrottle(uri, 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer th2.Close()
+
+	// requests are spaced out evenly, at most 5 per second and with no
+	// burst, so 11 requests take at least two seconds
+
+	t1 := time.Now()
+
+	wg := new(go_sync.WaitGroup)
+
+	for i := 0; i < 11; i++ {
+
+		wg.Add(1)
+
+		go func(i int) {
+
+			defer wg.Done()
+
+			th := th1
+
+			if i%2 == 0 {
+				th = th2
+			}
+
+			err := th.RateLimit()
+
+			if err != nil {
+				t.Error(err)
+			}
+
+		}(i)
+	}
+
+	wg.Wait()
+
+	if time.Since(t1) < 1900*time.Millisecond {
+		t.Fatalf("Expected requests to be throttled but they took %v", time.Since(t1))
+	}
+
+	_, err = NewRedisThrottle(fmt.Sprintf("redis://:wrong@%s/test", srv.Addr()), 5)
+
+	if err == nil {
+		t.Fatal("Expected an error for an invalid password")
+	}
+}
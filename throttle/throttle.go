@@ -3,6 +3,59 @@ package throttle
 // I will probably move this code in to its own package/repo
 // but not today (20171212/thisisaaronland)
 
+import (
+	"context"
+	"time"
+)
+
 type Throttle interface {
 	RateLimit() error
+	// RateLimitContext is the same as RateLimit except that it returns
+	// ctx.Err() as soon as ctx is cancelled rather than waiting any longer.
+	RateLimitContext(context.Context) error
+	// Report tells the throttle the outcome (nil for success) of whatever it
+	// was throttling, so that it can adjust its limits. Most throttles ignore it.
+	Report(error)
+}
+
+// NullThrottle is a Throttle that never limits anything.
+
+type NullThrottle struct {
+	Throttle
+}
+
+func NewNullThrottle() (Throttle, error) {
+	return &NullThrottle{}, nil
+}
+
+func (t *NullThrottle) RateLimit() error {
+	return nil
+}
+
+func (t *NullThrottle) RateLimitContext(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (t *NullThrottle) Report(err error) {
+	// pass
+}
+
+// sleep waits for d, or until ctx is cancelled in which case it returns
+// ctx.Err().
+
+func sleep(ctx context.Context, d time.Duration) error {
+
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
@@ -1,6 +1,7 @@
 package throttle
 
 import (
+	"context"
 	"errors"
 	"github.com/throttled/throttled"
 	"github.com/throttled/throttled/store/memstore"
@@ -10,11 +11,19 @@ import (
 type ThrottledThrottle struct {
 	Throttle
 	throttled *throttled.GCRARateLimiter
+	key       string
 	tts       int
 }
 
+// NewThrottledThrottle returns a Throttle that allows per_min operations per
+// minute. If per_min is less than 1 nothing is throttled.
+
 func NewThrottledThrottle(per_min int) (Throttle, error) {
 
+	if per_min < 1 {
+		return NewNullThrottle()
+	}
+
 	st, err := memstore.New(65536)
 
 	if err != nil {
@@ -22,7 +31,21 @@ func NewThrottledThrottle(per_min int) (Throttle, error) {
 	}
 
 	burst := int(float64(per_min) / 10.)
-	quota := throttled.RateQuota{throttled.PerMin(per_min), burst}
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(per_min), MaxBurst: burst}
+
+	t, err := newThrottledThrottle(st, "bucket", quota)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// newThrottledThrottle returns a ThrottledThrottle that limits requests for
+// key, in st, to quota using the GCRA algorithm.
+
+func newThrottledThrottle(st throttled.GCRAStore, key string, quota throttled.RateQuota) (*ThrottledThrottle, error) {
 
 	th, err := throttled.NewGCRARateLimiter(st, quota)
 
@@ -32,6 +55,7 @@ func NewThrottledThrottle(per_min int) (Throttle, error) {
 
 	t := ThrottledThrottle{
 		throttled: th,
+		key:       key,
 		tts:       100,
 	}
 
@@ -39,6 +63,10 @@ func NewThrottledThrottle(per_min int) (Throttle, error) {
 }
 
 func (t *ThrottledThrottle) RateLimit() error {
+	return t.RateLimitContext(context.Background())
+}
+
+func (t *ThrottledThrottle) RateLimitContext(ctx context.Context) error {
 
 	ms := t.tts
 
@@ -47,14 +75,20 @@ func (t *ThrottledThrottle) RateLimit() error {
 
 	for {
 
-		limited, _, err := t.throttled.RateLimit("bucket", 1)
+		limited, _, err := t.throttled.RateLimit(t.key, 1)
 
 		if err != nil {
 			return err
 		}
 
 		if limited {
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+
+			err := sleep(ctx, time.Duration(ms)*time.Millisecond)
+
+			if err != nil {
+				return err
+			}
+
 			ms += int(float64(ms) / 10.0)
 		} else {
 			break
@@ -69,3 +103,7 @@ func (t *ThrottledThrottle) RateLimit() error {
 
 	return nil
 }
+
+func (t *ThrottledThrottle) Report(err error) {
+	// pass
+}